@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"gualogger/handlers"
+	"sync"
+	"time"
+)
+
+// Collects raw values of the selected nodes and emits min/max/mean/count/first/last once per interval
+type Aggregator struct {
+	sync.Mutex
+	interval time.Duration
+	start    time.Time
+	nodes    map[string]bool
+	windows  map[string]*window
+}
+
+type window struct {
+	first handlers.Payload
+	last  handlers.Payload
+	count int
+	num   int
+	sum   float64
+	min   float64
+	max   float64
+}
+
+// Initializes a new aggregator, returns nil if no interval or nodes are configured
+func NewAggregator(c *AggregationConfig) *Aggregator {
+	if c.Interval <= 0 || len(c.Nodeids) == 0 {
+		return nil
+	}
+
+	a := new(Aggregator)
+	a.interval = time.Duration(c.Interval) * time.Second
+	a.start = time.Now().Truncate(a.interval)
+	a.nodes = make(map[string]bool)
+	a.windows = make(map[string]*window)
+
+	for _, n := range c.Nodeids {
+		a.nodes[nodeKey(n)] = true
+	}
+
+	return a
+}
+
+// Returns true if the node is configured for aggregation
+func (a *Aggregator) Selected(id string) bool {
+	if a == nil {
+		return false
+	}
+	return a.nodes[id]
+}
+
+// Adds a raw value to the current window of its node
+// Values of unselected nodes, samples without good quality, backfilled samples, which belong to past windows,
+// and heartbeats, which repeat an already counted sample, are ignored
+func (a *Aggregator) Add(p handlers.Payload) {
+	if !a.Selected(p.Id) || p.Quality != handlers.QualityGood || p.Backfill || p.Heartbeat {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	w, ok := a.windows[p.Id]
+
+	if !ok {
+		w = &window{first: p}
+		a.windows[p.Id] = w
+	}
+
+	w.last = p
+	w.count++
+
+	v, ok := toFloat(p.Value)
+
+	if !ok {
+		return
+	}
+
+	if w.num == 0 || v < w.min {
+		w.min = v
+	}
+	if w.num == 0 || v > w.max {
+		w.max = v
+	}
+	w.sum += v
+	w.num++
+}
+
+// Emits the aggregates of all nodes at the end of every interval until the context is cancelled
+// Windows are aligned to the interval, e.g. full minutes for an interval of 60 seconds
+func (a *Aggregator) Run(ctx context.Context, pub func(handlers.AggregatePayload)) {
+	for {
+		next := a.start.Add(a.interval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+			for _, p := range a.Flush(next) {
+				pub(p)
+			}
+		}
+	}
+}
+
+// Closes the current windows at end and returns their aggregates
+func (a *Aggregator) Flush(end time.Time) []handlers.AggregatePayload {
+	a.Lock()
+	defer a.Unlock()
+
+	pay := make([]handlers.AggregatePayload, 0, len(a.windows))
+
+	for id, w := range a.windows {
+		p := handlers.AggregatePayload{
+			Start:    a.start,
+			End:      end,
+			Count:    w.count,
+			First:    w.first.Value,
+			Last:     w.last.Value,
+			Name:     w.last.Name,
+			Id:       id,
+			Datatype: w.last.Datatype,
+			Server:   w.last.Server,
+		}
+
+		if w.num > 0 {
+			min, max, mean := w.min, w.max, w.sum/float64(w.num)
+			p.Min, p.Max, p.Mean = &min, &max, &mean
+		}
+
+		pay = append(pay, p)
+	}
+
+	a.start = end
+	a.windows = make(map[string]*window)
+
+	return pay
+}
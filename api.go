@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gualogger/logging"
+	"net/http"
+	"time"
+)
+
+// Time granted to finish running api requests on shutdown
+const apiShutdownTimeout = 5 * time.Second
+
+// Body of node change requests, browse paths are identified by their id in responses and errors
+type nodeRequest struct {
+	Nodeids     []string     `json:"nodeids"`
+	BrowsePaths []BrowsePath `json:"browse_paths"`
+}
+
+// Returns the ids of all requested nodes and the requested browse paths keyed by their id
+func (r nodeRequest) ids() ([]string, map[string]BrowsePath) {
+	ids := append([]string{}, r.Nodeids...)
+	paths := make(map[string]BrowsePath, len(r.BrowsePaths))
+
+	for _, p := range r.BrowsePaths {
+		ids = append(ids, p.ID())
+		paths[p.ID()] = p
+	}
+
+	return ids, paths
+}
+
+// Response of node change requests, errors are keyed by the failed node id
+type nodeResponse struct {
+	Nodeids []string          `json:"nodeids"`
+	Errors  map[string]string `json:"errors"`
+}
+
+// Serves the REST api until ctx is cancelled
+//
+//	GET    /nodes - returns the subscribed node ids
+//	POST   /nodes - adds the nodes of the body, e.g. {"nodeids": ["ns=2;s=Tag1"], "browse_paths": [{"start_node": "ns=2;s=Line1", "path": "2:Temperature"}]}
+//	DELETE /nodes - removes the nodes of the body
+func RunAPI(ctx context.Context, cfg *ApiConfig) {
+
+	if cfg.Port <= 0 {
+		return
+	}
+
+	// the api changes what is logged, it is never served without authentication
+	if cfg.Username == "" || cfg.Password == "" {
+		logging.Logger.Error("api username and password are required, api is not started", "func", "RunAPI")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nodes", cfg.authorize(handleNodes))
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+
+		sctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+		defer cancel()
+
+		srv.Shutdown(sctx)
+	}()
+
+	logging.Logger.Info(fmt.Sprintf("serving api on port %d", cfg.Port), "func", "RunAPI")
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logging.Logger.Error(fmt.Sprintf("unable to start api server on port %d: %s", cfg.Port, err.Error()), "func", "RunAPI")
+	}
+}
+
+// Requires basic authentication with the configured credentials
+func (cfg *ApiConfig) authorize(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(cfg.Username)) != 1 || subtle.ConstantTimeCompare([]byte(p), []byte(cfg.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gualogger"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+func handleNodes(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, nodeResponse{Nodeids: nodeset.NodeIDs(), Errors: map[string]string{}})
+		return
+	}
+
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req nodeRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	var errs map[string]error
+
+	ids, paths := req.ids()
+
+	if r.Method == http.MethodPost {
+		errs = nodeset.Add(r.Context(), ids, paths)
+	} else {
+		errs = nodeset.Remove(r.Context(), ids)
+	}
+
+	code := http.StatusOK
+
+	if len(errs) > 0 {
+		code = http.StatusUnprocessableEntity
+	}
+
+	writeJSON(w, code, nodeResponse{Nodeids: nodeset.NodeIDs(), Errors: errMessages(errs)})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Logger.Warn(fmt.Sprintf("unable to write api response: %s", err.Error()), "func", "RunAPI")
+	}
+}
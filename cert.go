@@ -1,91 +1,494 @@
 package main
 
 import (
+	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"gualogger/logging"
 	"math/big"
+	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
-func CreateKeyPair() error {
+const defaultApplicationName = "guanaco"
 
-	_, err0 := os.Stat("./certs")
+// Returns the configured application name, defaults to guanaco
+func (c *OpcConnection) AppName() string {
+	if c.ApplicationName == "" {
+		return defaultApplicationName
+	}
+	return c.ApplicationName
+}
 
-	if err0 != nil {
-		os.Mkdir("certs", 0777)
+// Returns the configured application uri, defaults to urn:{{hostname}}:{{application name}}
+func (c *OpcConnection) AppURI() string {
+	if c.ApplicationURI != "" {
+		return c.ApplicationURI
 	}
 
-	_, err1 := os.Stat("./certs/cert.pem")
-	_, err2 := os.Stat("./certs/key.pem")
+	host, err := os.Hostname()
+
+	if err != nil {
+		host = "localhost"
+	}
+
+	return fmt.Sprintf("urn:%s:%s", host, c.AppName())
+}
+
+// Creates a self-signed application instance certificate and private key at the given paths, existing files are kept
+// The certificate follows OPC UA Part 6: the ApplicationURI is the first SAN URI, hostname and ip addresses are added
+// as DNS and IP SANs, the serial is random and the certificate is not a CA
+func (c *OpcConnection) CreateKeyPair(certPath string, keyPath string) error {
+
+	_, err1 := os.Stat(certPath)
+	_, err2 := os.Stat(keyPath)
 
 	if err1 == nil && err2 == nil {
 		logging.Logger.Info("certificate and key already present - skipping creating")
 		return nil
 	}
 
-	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return err
+	}
+
+	pk, err := c.Certificate.GenerateKey()
 
 	if err != nil {
 		return err
 	}
 
-	hostName, err := os.Hostname()
+	tmpl, err := c.certTemplate()
 
 	if err != nil {
 		return err
 	}
 
-	u, err := url.Parse(hostName)
+	days := c.Certificate.ValidityDays
+
+	if days <= 0 {
+		days = 365
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
 
 	if err != nil {
 		return err
 	}
 
-	ca := x509.Certificate{
-		SerialNumber:          big.NewInt(1),
-		Subject:               pkix.Name{Country: []string{"DE"}, Organization: []string{"Guanaco@" + hostName}},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(24 * 3650 * time.Hour),
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageDataEncipherment | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign | x509.KeyUsageContentCommitment,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		URIs:                  []*url.URL{u},
+	pub, err := x509.MarshalPKIXPublicKey(pk.Public())
+
+	if err != nil {
+		return err
 	}
 
-	bArr, err := x509.CreateCertificate(rand.Reader, &ca, &ca, &pk.PublicKey, pk)
+	ski := sha1.Sum(pub)
+
+	// allow for small clock differences between client and server
+	tmpl.NotBefore = time.Now().Add(-1 * time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Duration(days) * 24 * time.Hour)
+	tmpl.SerialNumber = serial
+	tmpl.SubjectKeyId = ski[:]
+	tmpl.AuthorityKeyId = ski[:]
+	// self-signed application certificates additionally require keyCertSign
+	tmpl.KeyUsage |= x509.KeyUsageCertSign
+	tmpl.BasicConstraintsValid = true
+	tmpl.IsCA = false
+
+	bArr, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pk.Public(), pk)
 
 	if err != nil {
 		return err
 	}
-	cert, err := os.Create("./certs/cert.pem")
+
+	if err := writeKey(keyPath, pk); err != nil {
+		return err
+	}
+
+	if err := writeFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: bArr}), 0644); err != nil {
+		return err
+	}
+
+	logging.Logger.Info(fmt.Sprintf("created self-signed application certificate for %s valid until %s", c.AppURI(), tmpl.NotAfter.Format(time.DateOnly)), "func", "CreateKeyPair")
+
+	return nil
+}
+
+// Returns the subject, key usages and SANs shared by all application certificates
+func (c *OpcConnection) certTemplate() (*x509.Certificate, error) {
+
+	hostName, err := os.Hostname()
+
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(c.AppURI())
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid application uri %s: %s", c.AppURI(), err.Error())
+	}
+
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: c.AppName(), Organization: []string{c.AppName() + "@" + hostName}},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment | x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		URIs:        []*url.URL{u},
+		DNSNames:    []string{hostName},
+		IPAddresses: localIPs(),
+	}
+
+	return tmpl, nil
+}
+
+// Returns all non loopback and non link-local ip addresses of the host
+func localIPs() []net.IP {
+	ips := make([]net.IP, 0)
+
+	addrs, err := net.InterfaceAddrs()
+
+	if err != nil {
+		return ips
+	}
+
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && !n.IP.IsLinkLocalUnicast() {
+			ips = append(ips, n.IP)
+		}
+	}
+
+	return ips
+}
+
+// Loads a PEM or DER encoded certificate and RSA private key and verifies that both belong together
+// Returns the DER encoded certificate and the parsed key
+func LoadKeyPair(certPath string, keyPath string) ([]byte, *rsa.PrivateKey, error) {
+
+	if certPath == "" || keyPath == "" {
+		return nil, nil, fmt.Errorf("certificate_path and private_key_path must both be set")
+	}
+
+	cb, err := os.ReadFile(certPath)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read certificate %s: %w", certPath, err)
+	}
+
+	if b, _ := pem.Decode(cb); b != nil {
+		if b.Type != "CERTIFICATE" {
+			return nil, nil, fmt.Errorf("%s contains a %s pem block instead of a CERTIFICATE", certPath, b.Type)
+		}
+		cb = b.Bytes
+	}
+
+	cert, err := x509.ParseCertificate(cb)
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse certificate %s: %s", certPath, err.Error())
+	}
+
+	sk, err := LoadSigner(keyPath)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !keyMatches(cert, sk) {
+		return nil, nil, fmt.Errorf("private key %s does not match certificate %s", keyPath, certPath)
+	}
+
+	pk, ok := sk.(*rsa.PrivateKey)
+
+	if !ok {
+		return nil, nil, fmt.Errorf("private key %s is of type %T - the opc ua stack only supports RSA keys for connections", keyPath, sk)
+	}
+
+	return cb, pk, nil
+}
+
+// Loads a PEM or DER encoded RSA private key in PKCS#1 or PKCS#8 format
+func LoadPrivateKey(keyPath string) (*rsa.PrivateKey, error) {
+
+	sk, err := LoadSigner(keyPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rk, ok := sk.(*rsa.PrivateKey)
+
+	if !ok {
+		return nil, fmt.Errorf("private key %s is of type %T - only RSA keys are supported", keyPath, sk)
+	}
+
+	return rk, nil
+}
+
+// Loads a PEM or DER encoded RSA or ECC private key in PKCS#1, SEC 1 or PKCS#8 format
+func LoadSigner(keyPath string) (crypto.Signer, error) {
+
+	kb, err := os.ReadFile(keyPath)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key %s: %w", keyPath, err)
+	}
+
+	if b, _ := pem.Decode(kb); b != nil {
+		kb = b.Bytes
+	}
+
+	if k, err := x509.ParsePKCS1PrivateKey(kb); err == nil {
+		return k, nil
+	}
+
+	if k, err := x509.ParseECPrivateKey(kb); err == nil {
+		return k, nil
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(kb)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key %s: neither PKCS#1, SEC 1 nor PKCS#8 encoded", keyPath)
+	}
+
+	sk, ok := k.(crypto.Signer)
+
+	if !ok {
+		return nil, fmt.Errorf("private key %s is of unsupported type %T", keyPath, k)
+	}
+
+	return sk, nil
+}
+
+// Returns true if the public key of the certificate belongs to the private key
+func keyMatches(cert *x509.Certificate, sk crypto.Signer) bool {
+	pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(sk.Public())
+}
+
+// Generates a new RSA private key of the configured size, 2048, 3072 or 4096 bit
+// The opc ua stack only implements RSA based security policies, so no other key types are created
+func (c *OpcCerts) GenerateKey() (*rsa.PrivateKey, error) {
+
+	size := c.KeySize
+
+	if size == 0 {
+		size = 2048
+	}
+
+	if size != 2048 && size != 3072 && size != 4096 {
+		return nil, fmt.Errorf("unsupported key size %d - possible values are 2048, 3072 and 4096", size)
+	}
+
+	return rsa.GenerateKey(rand.Reader, size)
+}
+
+// Writes a private key pem encoded as PKCS#1, only readable by the owner
+func writeKey(path string, k *rsa.PrivateKey) error {
+	return writeFile(path, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), 0600)
+}
+
+// Writes data to a temporary file next to path and renames it, readers never see a partially written file
+func writeFile(path string, data []byte, perm os.FileMode) error {
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
 
 	if err != nil {
 		return err
 	}
 
-	defer cert.Close()
+	defer os.Remove(f.Name())
 
-	if err := pem.Encode(cert, &pem.Block{Type: "CERTIFICATE", Bytes: bArr}); err != nil {
+	if _, err := f.Write(data); err != nil {
+		f.Close()
 		return err
 	}
 
-	key, err := os.Create("./certs/key.pem")
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Returns the application certificate and key paths - the PKI own/ folder if auto_create is set, otherwise the configured paths
+func (c *OpcCerts) KeyPairPaths() (string, string) {
+	if c.AutoCreate {
+		p := NewPKI(c.PKIRoot)
+		return p.OwnCert(), p.OwnKey()
+	}
+	return c.CertificatePath, c.PrivateKeyPath
+}
+
+const renewCheckInterval = 12 * time.Hour
+
+// Checks the expiry of the application certificate on startup and every 12 hours until ctx is cancelled
+func (c *OpcConnection) RunCertRenewal(ctx context.Context) {
+
+	if c.Policy == "None" {
+		return
+	}
+
+	tick := time.NewTicker(renewCheckInterval)
+	defer tick.Stop()
+
+	for {
+		if err := c.RenewKeyPair(); err != nil {
+			logging.Logger.Error(fmt.Sprintf("error while checking application certificate: %s", err.Error()), "func", "RunCertRenewal")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// Serializes creating, renewing and loading the application key pair
+var keypair_mu sync.Mutex
+
+// Renews the application certificate if it expires within renew_before_days
+// Auto created certificates are archived and replaced by a new key pair, which is picked up by the next CreateClient call.
+// For externally provided certificates a certificate signing request is written next to the certificate.
+func (c *OpcConnection) RenewKeyPair() error {
+
+	keypair_mu.Lock()
+	defer keypair_mu.Unlock()
+
+	cp, kp := c.Certificate.KeyPairPaths()
+
+	der, _, err := LoadKeyPair(cp, kp)
 
 	if err != nil {
+		if c.Certificate.AutoCreate && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
 		return err
 	}
 
-	defer key.Close()
+	cert, err := x509.ParseCertificate(der)
 
-	if err := pem.Encode(key, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pk)}); err != nil {
+	if err != nil {
 		return err
 	}
 
+	days := c.Certificate.RenewBeforeDays
+
+	if days <= 0 {
+		days = 30
+	}
+
+	left := time.Until(cert.NotAfter)
+
+	if left > time.Duration(days)*24*time.Hour {
+		logging.Logger.Debug(fmt.Sprintf("application certificate valid until %s", cert.NotAfter.Format(time.DateOnly)), "func", "RenewKeyPair")
+		return nil
+	}
+
+	if !c.Certificate.AutoCreate {
+		logging.Logger.Warn(fmt.Sprintf("application certificate %s expires on %s - writing a certificate signing request, import the signed certificate with 'gualogger cert import'", cp, cert.NotAfter.Format(time.DateOnly)), "func", "RenewKeyPair")
+		return c.WriteCSR("")
+	}
+
+	logging.Logger.Warn(fmt.Sprintf("application certificate expires on %s - renewing", cert.NotAfter.Format(time.DateOnly)), "func", "RenewKeyPair")
+
+	// the new pair is created next to the old one, which is only archived once the new pair exists
+	nc, nk := cp+".new", kp+".new"
+
+	os.Remove(nc)
+	os.Remove(nk)
+
+	if err := c.CreateKeyPair(nc, nk); err != nil {
+		return err
+	}
+
+	if err := archiveKeyPair(cp, kp); err != nil {
+		return fmt.Errorf("unable to archive application certificate: %s", err.Error())
+	}
+
+	if err := os.Rename(nk, kp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(nc, cp); err != nil {
+		return err
+	}
+
+	logging.Logger.Info("renewed application certificate - it is used from the next reconnect on", "func", "RenewKeyPair")
+
+	return nil
+}
+
+// Moves certificate and key into archive folders next to them, suffixed with the current time
+func archiveKeyPair(certPath string, keyPath string) error {
+
+	for _, f := range []string{certPath, keyPath} {
+		if err := archiveFile(f); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// Moves a file into an archive folder next to it, suffixed with the current time
+func archiveFile(f string) error {
+
+	p, err := archivePath(f)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f, p)
+}
+
+// Writes data as archived copy of f, used when f itself has already been replaced
+func archiveData(f string, data []byte) error {
+
+	p, err := archivePath(f)
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(p, data, 0600)
+}
+
+// Returns the timestamped path of f in the archive directory next to it, the directory is created if missing
+func archivePath(f string) (string, error) {
+
+	dir := filepath.Join(filepath.Dir(f), "archive")
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	ext := filepath.Ext(f)
+	name := strings.TrimSuffix(filepath.Base(f), ext)
+	ts := time.Now().Format("20060102-150405")
+
+	return filepath.Join(dir, fmt.Sprintf("%s-%s%s", name, ts, ext)), nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"gualogger/logging"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const certUsage = `usage:
+  gualogger cert csr [-out file]          write a PKCS#10 certificate signing request for the application certificate
+  gualogger cert import cert [chain...]   install a CA signed application certificate and its chain`
+
+// Runs the cert sub commands and returns the exit code
+func RunCertCommand(args []string) int {
+
+	if len(args) == 0 {
+		fmt.Println(certUsage)
+		return 2
+	}
+
+	var err error
+
+	switch args[0] {
+	case "csr":
+		fs := flag.NewFlagSet("csr", flag.ContinueOnError)
+		out := fs.String("out", "", "path of the written csr, defaults to request.csr next to the certificate")
+
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+
+		err = conf.Opcua.Connection.WriteCSR(*out)
+
+	case "import":
+		if len(args) < 2 {
+			fmt.Println(certUsage)
+			return 2
+		}
+
+		err = conf.Opcua.Connection.ImportCertificate(args[1], args[2:])
+
+	default:
+		fmt.Println(certUsage)
+		return 2
+	}
+
+	if err != nil {
+		logging.Logger.Error(err.Error(), "func", "RunCertCommand")
+		return 1
+	}
+
+	return 0
+}
+
+// Writes a certificate signing request with the ApplicationURI and SANs of the application certificate
+// The existing private key is used, if none exists a new one is created at the configured key path
+func (c *OpcConnection) WriteCSR(out string) error {
+
+	cp, kp := c.Certificate.KeyPairPaths()
+
+	if cp == "" || kp == "" {
+		return fmt.Errorf("certificate_path and private_key_path must be set to create a csr")
+	}
+
+	if out == "" {
+		out = filepath.Join(filepath.Dir(cp), "request.csr")
+	}
+
+	pk, err := c.loadOrCreateKey(kp)
+
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := c.certTemplate()
+
+	if err != nil {
+		return err
+	}
+
+	req := &x509.CertificateRequest{
+		Subject:     tmpl.Subject,
+		URIs:        tmpl.URIs,
+		DNSNames:    tmpl.DNSNames,
+		IPAddresses: tmpl.IPAddresses,
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, req, pk)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), 0644); err != nil {
+		return err
+	}
+
+	logging.Logger.Info(fmt.Sprintf("wrote certificate signing request for %s to %s", c.AppURI(), out), "func", "WriteCSR")
+
+	return nil
+}
+
+// Returns the private key at path, a new key is created if the file does not exist
+func (c *OpcConnection) loadOrCreateKey(path string) (*rsa.PrivateKey, error) {
+
+	pk, err := LoadPrivateKey(path)
+
+	if err == nil {
+		return pk, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	pk, err = c.Certificate.GenerateKey()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := writeKey(path, pk); err != nil {
+		return nil, err
+	}
+
+	logging.Logger.Info(fmt.Sprintf("created new private key %s", path), "func", "WriteCSR")
+
+	return pk, nil
+}
+
+// Returns an error if cert is outside its validity period at now or does not chain to one of the issuers
+// Self-signed certificates need no issuer
+func verifyImport(cert *x509.Certificate, issuers []*x509.Certificate, now time.Time) error {
+
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate is only valid from %s until %s", cert.NotBefore.Format(time.DateOnly), cert.NotAfter.Format(time.DateOnly))
+	}
+
+	if cert.CheckSignatureFrom(cert) == nil {
+		return nil
+	}
+
+	roots := x509.NewCertPool()
+	for _, c := range issuers {
+		roots.AddCert(c)
+	}
+
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, CurrentTime: now, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return fmt.Errorf("certificate does not chain to the supplied issuers: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Installs a CA signed certificate as application certificate after checking that it matches the private key,
+// is currently valid and chains to the supplied or already installed issuers.
+// Additional certificates in the file or the chain files are installed to the issuers store, a replaced certificate is archived
+func (c *OpcConnection) ImportCertificate(certFile string, chainFiles []string) error {
+
+	cp, kp := c.Certificate.KeyPairPaths()
+
+	b, err := os.ReadFile(certFile)
+
+	if err != nil {
+		return err
+	}
+
+	certs := make([]*x509.Certificate, 0)
+
+	for _, der := range decodeBlocks(b, "CERTIFICATE") {
+		crt, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("unable to parse certificate %s: %s", certFile, err.Error())
+		}
+		certs = append(certs, crt)
+	}
+
+	for _, f := range chainFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		for _, der := range decodeBlocks(b, "CERTIFICATE") {
+			crt, err := x509.ParseCertificate(der)
+			if err != nil {
+				return fmt.Errorf("unable to parse chain certificate %s: %s", f, err.Error())
+			}
+			certs = append(certs, crt)
+		}
+	}
+
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate found in %s", certFile)
+	}
+
+	leaf := certs[0]
+
+	pk, err := LoadPrivateKey(kp)
+
+	if err != nil {
+		return err
+	}
+
+	if !keyMatches(leaf, pk) {
+		return fmt.Errorf("certificate %s does not match private key %s", certFile, kp)
+	}
+
+	uri := false
+	for _, u := range leaf.URIs {
+		if u.String() == c.AppURI() {
+			uri = true
+		}
+	}
+
+	if !uri {
+		logging.Logger.Warn(fmt.Sprintf("certificate does not contain the application uri %s - the server might reject it", c.AppURI()), "func", "ImportCertificate")
+	}
+
+	pki := NewPKI(c.Certificate.PKIRoot)
+
+	if err := pki.Setup(); err != nil {
+		return err
+	}
+
+	issuers := append([]*x509.Certificate{}, certs[1:]...)
+	issuers = append(issuers, loadCerts(pki.IssuerCerts())...)
+	issuers = append(issuers, loadCerts(pki.TrustedCerts())...)
+
+	if err := verifyImport(leaf, issuers, time.Now()); err != nil {
+		return fmt.Errorf("certificate %s is not installed: %s", certFile, err.Error())
+	}
+
+	for _, ca := range certs[1:] {
+		if err := writeCert(pki.IssuerCerts(), ca); err != nil {
+			return err
+		}
+		logging.Logger.Info(fmt.Sprintf("installed issuer certificate %s", ca.Subject.CommonName), "func", "ImportCertificate")
+	}
+
+	old, err := os.ReadFile(cp)
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cp), 0755); err != nil {
+		return err
+	}
+
+	// the certificate is replaced atomically, a running gualogger never finds the certificate missing
+	if err := writeFile(cp, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}), 0644); err != nil {
+		return err
+	}
+
+	if old != nil {
+		if err := archiveData(cp, old); err != nil {
+			logging.Logger.Warn(fmt.Sprintf("unable to archive replaced certificate: %s", err.Error()), "func", "ImportCertificate")
+		}
+	}
+
+	logging.Logger.Info(fmt.Sprintf("installed application certificate %s valid until %s", cp, leaf.NotAfter.Format(time.DateOnly)), "func", "ImportCertificate")
+
+	return nil
+}
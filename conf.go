@@ -1,35 +1,124 @@
 package main
 
 import (
+	"fmt"
 	"gualogger/handlers"
+	"strings"
+	"time"
 
+	"github.com/gopcua/opcua"
 	"github.com/spf13/viper"
 )
 
 type Configuration struct {
-	Opcua     OpcConfig              `mapstructure:"opcua"`
-	ExpMap    map[string]interface{} `mapstructure:"exporters"`
-	Exporters Exporters              `mapstructure:"exporters"`
+	Opcua       OpcConfig              `mapstructure:"opcua"`
+	Aggregation AggregationConfig      `mapstructure:"aggregation"`
+	ExpMap      map[string]interface{} `mapstructure:"exporters"`
+	Exporters   Exporters              `mapstructure:"exporters"`
+	Api         ApiConfig              `mapstructure:"api"`
+}
+
+// REST api to add and remove monitored nodes at runtime, disabled if no port is set and not started without username and password
+type ApiConfig struct {
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+type AggregationConfig struct {
+	Interval int      `mapstructure:"interval"`
+	Nodeids  []string `mapstructure:"nodeids"`
 }
 
 type OpcConfig struct {
 	Connection   OpcConnection `mapstructure:"connection"`
 	Subscription Subscription  `mapstructure:"subscription"`
+	Events       EventConfig   `mapstructure:"events"`
+}
+
+type EventConfig struct {
+	Notifiers []string `mapstructure:"notifiers"`
+	Interval  int      `mapstructure:"interval"`
 }
 
 type Subscription struct {
-	Nodeids  []string `mapstructure:"nodeids"`
-	Interval int      `mapstructure:"sub_interval"`
+	Nodeids    []string         `mapstructure:"nodeids"`
+	Nodes      []NodeConfig     `mapstructure:"nodes"`
+	Interval   int              `mapstructure:"sub_interval"`
+	Monitoring MonitoringConfig `mapstructure:"monitoring"`
+	Backfill   bool             `mapstructure:"backfill"`
+	Groups     []NodeGroup      `mapstructure:"groups"`
+	NameSource string           `mapstructure:"name_source"`
+	Flatten    bool             `mapstructure:"flatten_structs"`
+
+	TimestampSource string `mapstructure:"timestamp_source"`
+	ClockSkew       int    `mapstructure:"clock_skew_threshold"`
+
+	Settings SubscriptionSettings `mapstructure:",squash"`
+}
+
+// Named group of nodes, which either get their own subscription or are read cyclically
+type NodeGroup struct {
+	Name         string       `mapstructure:"name"`
+	Mode         string       `mapstructure:"mode"`
+	PollInterval int          `mapstructure:"poll_interval"`
+	OnlyChanges  bool         `mapstructure:"only_changes"`
+	Nodeids      []string     `mapstructure:"nodeids"`
+	Nodes        []NodeConfig `mapstructure:"nodes"`
+
+	Settings SubscriptionSettings `mapstructure:",squash"`
+}
+
+// Parameters of a data change subscription, unset values of a group fall back to the subscription defaults
+// The publishing interval is given in milliseconds and takes precedence over sub_interval
+type SubscriptionSettings struct {
+	PublishingInterval int    `mapstructure:"publishing_interval"`
+	Priority           uint8  `mapstructure:"priority"`
+	LifetimeCount      uint32 `mapstructure:"lifetime_count"`
+	KeepAliveCount     uint32 `mapstructure:"keepalive_count"`
+}
+
+// Possible modes of a node group, defaults to subscribe
+const (
+	GroupModeSubscribe = "subscribe"
+	GroupModePoll      = "poll"
+)
+
+// Per node settings - nodes listed here are monitored in addition to the entries of nodeids
+// A node is either identified by its node id or by a browse path relative to start_node, which defaults to the Root folder
+type NodeConfig struct {
+	NodeID      string  `mapstructure:"nodeid"`
+	BrowsePath  string  `mapstructure:"browse_path"`
+	StartNode   string  `mapstructure:"start_node"`
+	DeadbandAbs float64 `mapstructure:"deadband_abs"`
+	DeadbandPct float64 `mapstructure:"deadband_pct"`
+	MaxSilence  int     `mapstructure:"max_silence"`
+
+	TimestampSource string `mapstructure:"timestamp_source"`
+
+	Monitoring *MonitoringConfig `mapstructure:"monitoring"`
+}
+
+// Server side monitored item settings, unset values fall back to the subscription defaults
+type MonitoringConfig struct {
+	SamplingInterval *float64 `mapstructure:"sampling_interval"`
+	QueueSize        uint32   `mapstructure:"queue_size"`
+	DiscardOldest    *bool    `mapstructure:"discard_oldest"`
+	Trigger          string   `mapstructure:"trigger"`
+	DeadbandType     string   `mapstructure:"deadband_type"`
+	DeadbandValue    float64  `mapstructure:"deadband_value"`
 }
 
 type OpcConnection struct {
-	Endpoint       string            `mapstructure:"endpoint"`
-	Port           int               `mapstructure:"port"`
-	Mode           string            `mapstructure:"mode"`
-	Policy         string            `mapstructure:"policy"`
-	Authentication OpcAuthentication `mapstructure:"authentication"`
-	Certificate    OpcCerts          `mapstructure:"certificate"`
-	Retries        int               `mapstructure:"retry_count"`
+	Endpoint        string            `mapstructure:"endpoint"`
+	Port            int               `mapstructure:"port"`
+	Mode            string            `mapstructure:"mode"`
+	Policy          string            `mapstructure:"policy"`
+	Authentication  OpcAuthentication `mapstructure:"authentication"`
+	Certificate     OpcCerts          `mapstructure:"certificate"`
+	Retries         int               `mapstructure:"retry_count"`
+	ApplicationName string            `mapstructure:"application_name"`
+	ApplicationURI  string            `mapstructure:"application_uri"`
 }
 
 type OpcAuthentication struct {
@@ -48,6 +137,11 @@ type OpcCerts struct {
 	AutoCreate      bool   `mapstructure:"auto_create"`
 	CertificatePath string `mapstructure:"certificate_path"`
 	PrivateKeyPath  string `mapstructure:"private_key_path"`
+	PKIRoot         string `mapstructure:"pki_root"`
+	TrustOnFirstUse bool   `mapstructure:"trust_on_first_use"`
+	KeySize         int    `mapstructure:"key_size"`
+	ValidityDays    int    `mapstructure:"validity_days"`
+	RenewBeforeDays int    `mapstructure:"renew_before_days"`
 }
 
 type Exporters struct {
@@ -74,9 +168,208 @@ func LoadConfig() (*Configuration, error) {
 		return &conf, err
 	}
 
+	if err := conf.Validate(); err != nil {
+		return &conf, err
+	}
+
+	registerPaths(conf.Opcua.Subscription.BrowsePaths())
+
 	return &conf, nil
 }
 
+// Rejects settings that are only detected late at runtime otherwise
+func (c *Configuration) Validate() error {
+	if err := c.Opcua.Connection.Validate(); err != nil {
+		return err
+	}
+	return c.Opcua.Subscription.Validate()
+}
+
+// Subscribe groups are identified by their name, the empty name is the default subscription
+// Group names must be unique across subscribe and poll groups
+func (s *Subscription) Validate() error {
+	names := make(map[string]bool, len(s.Groups))
+
+	for i, g := range s.Groups {
+		if g.Name == "" && g.Mode != GroupModePoll {
+			return fmt.Errorf("subscribe group %d has no name", i+1)
+		}
+		if g.Name != "" && names[g.Name] {
+			return fmt.Errorf("group name %s is used more than once", g.Name)
+		}
+		names[g.Name] = true
+	}
+
+	return nil
+}
+
+// The opc ua stack only implements RSA based security policies, ECC policies are refused at config load
+func (c *OpcConnection) Validate() error {
+	if strings.HasPrefix(c.Policy, "ECC_") {
+		return fmt.Errorf("security policy %s is not supported - the opc ua stack only implements RSA based security policies", c.Policy)
+	}
+
+	return nil
+}
+
+// Returns the node ids of all subscribed nodes configured in nodeids, nodes and subscribe groups without duplicates
+func (s *Subscription) NodeIDs() []string {
+	seen := make(map[string]bool)
+
+	ids := appendNodeIDs(nil, seen, s.Nodeids, s.Nodes)
+
+	for _, g := range s.Groups {
+		if g.Mode != GroupModePoll {
+			ids = appendNodeIDs(ids, seen, g.Nodeids, g.Nodes)
+		}
+	}
+
+	return ids
+}
+
+// Returns the node ids of every data change subscription keyed by group name, the default subscription has the empty name
+// Nodes listed more than once belong to the first subscription listing them
+func (s *Subscription) SubscriptionNodeIDs() map[string][]string {
+	seen := make(map[string]bool)
+
+	ids := map[string][]string{"": appendNodeIDs(nil, seen, s.Nodeids, s.Nodes)}
+
+	for _, g := range s.Groups {
+		if g.Mode != GroupModePoll {
+			ids[g.Name] = appendNodeIDs(ids[g.Name], seen, g.Nodeids, g.Nodes)
+		}
+	}
+
+	return ids
+}
+
+// Returns the parameters of the subscription of a group, the default subscription has the empty name
+func (s *Subscription) Parameters(group string) *opcua.SubscriptionParameters {
+	set := s.Settings
+
+	for _, g := range s.Groups {
+		if g.Name == group && group != "" && g.Mode != GroupModePoll {
+			set = set.Merge(g.Settings)
+			break
+		}
+	}
+
+	p := &opcua.SubscriptionParameters{
+		Interval:          time.Duration(s.Interval) * time.Second,
+		Priority:          set.Priority,
+		LifetimeCount:     set.LifetimeCount,
+		MaxKeepAliveCount: set.KeepAliveCount,
+	}
+
+	if set.PublishingInterval > 0 {
+		p.Interval = time.Duration(set.PublishingInterval) * time.Millisecond
+	}
+
+	return p
+}
+
+// Overlays the settings of a group on the subscription defaults m
+// Publishing interval, priority, lifetime and keepalive count of o replace those of m, zero means unset and keeps the default
+func (m SubscriptionSettings) Merge(o SubscriptionSettings) SubscriptionSettings {
+	if o.PublishingInterval > 0 {
+		m.PublishingInterval = o.PublishingInterval
+	}
+	if o.Priority != 0 {
+		m.Priority = o.Priority
+	}
+	if o.LifetimeCount != 0 {
+		m.LifetimeCount = o.LifetimeCount
+	}
+	if o.KeepAliveCount != 0 {
+		m.KeepAliveCount = o.KeepAliveCount
+	}
+
+	return m
+}
+
+// Returns the node ids of all configured nodes, including polled groups
+func (s *Subscription) AllNodeIDs() []string {
+	seen := make(map[string]bool)
+
+	ids := appendNodeIDs(nil, seen, s.Nodeids, s.Nodes)
+
+	for _, g := range s.Groups {
+		ids = appendNodeIDs(ids, seen, g.Nodeids, g.Nodes)
+	}
+
+	return ids
+}
+
+// Returns the node ids of the group without duplicates
+func (g *NodeGroup) NodeIDs() []string {
+	return appendNodeIDs(nil, make(map[string]bool), g.Nodeids, g.Nodes)
+}
+
+func appendNodeIDs(ids []string, seen map[string]bool, nodeids []string, nodes []NodeConfig) []string {
+	for _, n := range nodeids {
+		if !seen[n] {
+			seen[n] = true
+			ids = append(ids, n)
+		}
+	}
+
+	for _, n := range nodes {
+		if !seen[n.ID()] {
+			seen[n.ID()] = true
+			ids = append(ids, n.ID())
+		}
+	}
+
+	return ids
+}
+
+// Returns the configured identifier of the node, the id of the browse path and start node is used if no node id is set
+func (n NodeConfig) ID() string {
+	if n.NodeID != "" {
+		return n.NodeID
+	}
+	return n.Path().ID()
+}
+
+// Returns the browse path of the node relative to its start node
+func (n NodeConfig) Path() BrowsePath {
+	return BrowsePath{StartNode: n.StartNode, Path: n.BrowsePath}
+}
+
+// Returns all nodes configured by browse path, keyed by their id
+func (s *Subscription) BrowsePaths() map[string]BrowsePath {
+	paths := make(map[string]BrowsePath)
+
+	for _, n := range s.NodeConfigs() {
+		if n.NodeID == "" && n.BrowsePath != "" {
+			paths[n.ID()] = n.Path()
+		}
+	}
+
+	return paths
+}
+
+// Returns the per node settings of the subscription and all groups
+func (s *Subscription) NodeConfigs() []NodeConfig {
+	nodes := append([]NodeConfig{}, s.Nodes...)
+
+	for _, g := range s.Groups {
+		nodes = append(nodes, g.Nodes...)
+	}
+
+	return nodes
+}
+
+// Returns the monitoring settings of a node merged on top of the subscription defaults
+func (s *Subscription) MonitoringFor(id string) MonitoringConfig {
+	for _, n := range s.NodeConfigs() {
+		if nodeKey(n.ID()) == nodeKey(id) {
+			return s.Monitoring.Merge(n.Monitoring)
+		}
+	}
+	return s.Monitoring
+}
+
 // Returns a map of all possible Exporters
 // To add a new Exporter add a new entry in format [`conf key name`]=Exporter struct
 
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestSubscriptionValidateGroupNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups []NodeGroup
+		ok     bool
+	}{
+		{"unique", []NodeGroup{{Name: "fast"}, {Name: "slow", Mode: GroupModeSubscribe}, {Name: "cyclic", Mode: GroupModePoll}}, true},
+		{"unnamed poll group", []NodeGroup{{Mode: GroupModePoll}}, true},
+		{"unnamed subscribe group", []NodeGroup{{Name: "fast"}, {Mode: GroupModeSubscribe}}, false},
+		{"duplicate subscribe group", []NodeGroup{{Name: "fast"}, {Name: "fast"}}, false},
+		{"duplicate across modes", []NodeGroup{{Name: "fast"}, {Name: "fast", Mode: GroupModePoll}}, false},
+	}
+
+	for _, tc := range tests {
+		s := Subscription{Groups: tc.groups}
+		if err := s.Validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: got error %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"gualogger/handlers"
+	"gualogger/logging"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Fields selected from each event, the order matches the EventFields of a notification
+var eventFields = []struct {
+	typeDef uint32
+	path    []string
+}{
+	{id.BaseEventType, []string{"EventId"}},
+	{id.BaseEventType, []string{"EventType"}},
+	{id.BaseEventType, []string{"SourceName"}},
+	{id.BaseEventType, []string{"Time"}},
+	{id.BaseEventType, []string{"Severity"}},
+	{id.BaseEventType, []string{"Message"}},
+	{id.AlarmConditionType, []string{"ActiveState", "Id"}},
+	{id.AcknowledgeableConditionType, []string{"AckedState", "Id"}},
+}
+
+// Creates an event subscription on all configured notifier nodes and publishes received events until ctx is cancelled
+// Status change notifications of the subscription are reported to lost
+func CreateEventSubscription(pctx context.Context, ctx context.Context, c *opcua.Client, e *EventConfig, lost func(error), wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	notifyCh := make(chan *opcua.PublishNotificationData, 256)
+
+	sub, err := c.Subscribe(pctx, &opcua.SubscriptionParameters{Interval: time.Duration(e.Interval) * time.Second}, notifyCh)
+
+	if err != nil {
+		logging.Logger.Error(fmt.Sprintf("error while creating event subscription: %s", err.Error()), "func", "CreateEventSubscription")
+		return
+	}
+
+	defer func() {
+		tctx, cancel := context.WithTimeout(context.Background(), terminateTimeout)
+		defer cancel()
+		sub.Cancel(tctx)
+	}()
+
+	notifiers := make(map[uint32]string)
+
+	for i, n := range e.Notifiers {
+		nid, ok := resolver.NodeID(n)
+
+		if !ok {
+			continue
+		}
+
+		handle := uint32(i + 1)
+
+		res, err := sub.Monitor(ctx, ua.TimestampsToReturnBoth, eventRequest(nid, handle))
+
+		if err != nil {
+			logging.Logger.Error(fmt.Sprintf("error adding event notifier %s: %s", n, err.Error()), "func", "CreateEventSubscription")
+			continue
+		}
+
+		if res.Results[0].StatusCode != ua.StatusOK {
+			logging.Logger.Error(fmt.Sprintf("error adding event notifier %s: %s", n, res.Results[0].StatusCode), "func", "CreateEventSubscription")
+			continue
+		}
+
+		notifiers[handle] = nodeKey(n)
+	}
+
+	logging.Logger.Info(fmt.Sprintf("successfully initialized event subscription with id:%d", sub.SubscriptionID))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case res := <-notifyCh:
+			if res.Error != nil {
+				logging.Logger.Error(fmt.Sprintf("error with received event message: %s", res.Error.Error()), "func", "CreateEventSubscription")
+				continue
+			}
+
+			if sc, ok := res.Value.(*ua.StatusChangeNotification); ok {
+				lost(fmt.Errorf("event subscription status changed to %s", sc.Status))
+				continue
+			}
+
+			l, ok := res.Value.(*ua.EventNotificationList)
+
+			if !ok {
+				continue
+			}
+
+			for _, ev := range l.Events {
+				mgr.PublishEvent(ctx, ParseEvent(notifiers[ev.ClientHandle], ev.EventFields))
+			}
+		}
+	}
+}
+
+func eventRequest(nid *ua.NodeID, handle uint32) *ua.MonitoredItemCreateRequest {
+
+	selects := make([]*ua.SimpleAttributeOperand, len(eventFields))
+
+	for i, f := range eventFields {
+		path := make([]*ua.QualifiedName, len(f.path))
+
+		for j, p := range f.path {
+			path[j] = &ua.QualifiedName{NamespaceIndex: 0, Name: p}
+		}
+
+		selects[i] = &ua.SimpleAttributeOperand{
+			TypeDefinitionID: ua.NewNumericNodeID(0, f.typeDef),
+			BrowsePath:       path,
+			AttributeID:      ua.AttributeIDValue,
+		}
+	}
+
+	return &ua.MonitoredItemCreateRequest{
+		ItemToMonitor: &ua.ReadValueID{
+			NodeID:       nid,
+			AttributeID:  ua.AttributeIDEventNotifier,
+			DataEncoding: &ua.QualifiedName{},
+		},
+		MonitoringMode: ua.MonitoringModeReporting,
+		RequestedParameters: &ua.MonitoringParameters{
+			ClientHandle:  handle,
+			DiscardOldest: true,
+			Filter:        ua.NewExtensionObject(&ua.EventFilter{SelectClauses: selects, WhereClause: &ua.ContentFilter{}}),
+			QueueSize:     100,
+		},
+	}
+}
+
+// Converts the selected event fields into an event payload, fields not provided by the event type stay empty
+func ParseEvent(notifier string, fields []*ua.Variant) handlers.EventPayload {
+
+	p := handlers.EventPayload{Notifier: notifier}
+
+	val := func(i int) interface{} {
+		if i >= len(fields) || fields[i] == nil {
+			return nil
+		}
+		return fields[i].Value()
+	}
+
+	if v, ok := val(0).([]byte); ok {
+		p.EventId = hex.EncodeToString(v)
+	}
+	if v, ok := val(1).(*ua.NodeID); ok {
+		p.EventType = v.String()
+	}
+	if v, ok := val(2).(string); ok {
+		p.SourceName = v
+	}
+	if v, ok := val(3).(time.Time); ok {
+		p.TS = v
+	}
+	if v, ok := val(4).(uint16); ok {
+		p.Severity = v
+	}
+	if v, ok := val(5).(*ua.LocalizedText); ok {
+		p.Message = v.Text
+	}
+	if v, ok := val(6).(bool); ok {
+		p.Active = &v
+	}
+	if v, ok := val(7).(bool); ok {
+		p.Acked = &v
+	}
+
+	return p
+}
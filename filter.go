@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gualogger/handlers"
+	"gualogger/logging"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var filter *ChangeFilter
+
+// Client side deadband and change-of-value filter applied before payloads are handed to the exporters
+type ChangeFilter struct {
+	sync.Mutex
+	nodes map[string]*filterState
+}
+
+type filterState struct {
+	cfg     NodeConfig
+	last    handlers.Payload
+	lastPub time.Time
+	valid   bool
+}
+
+// Initializes a new filter for all nodes with configured deadband or heartbeat settings
+func NewChangeFilter(nodes []NodeConfig) *ChangeFilter {
+	f := new(ChangeFilter)
+	f.nodes = make(map[string]*filterState)
+
+	for _, n := range nodes {
+		if n.DeadbandAbs <= 0 && n.DeadbandPct <= 0 && n.MaxSilence <= 0 {
+			continue
+		}
+
+		f.nodes[nodeKey(n.ID())] = &filterState{cfg: n}
+	}
+
+	return f
+}
+
+// Returns true if the payload should be published. Nodes without filter settings always pass.
+// For filtered nodes a value is published when it differs from the last published one and exceeds every configured deadband,
+// or when its status code changed
+func (f *ChangeFilter) Pass(p handlers.Payload) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	s, ok := f.nodes[p.Id]
+
+	if !ok {
+		return true
+	}
+
+	if s.valid && s.last.Status == p.Status && !s.exceeds(p.Value) {
+		return false
+	}
+
+	s.last = p
+	s.lastPub = time.Now()
+	s.valid = true
+
+	return true
+}
+
+func (s *filterState) exceeds(v interface{}) bool {
+	nv, ok1 := toFloat(v)
+	lv, ok2 := toFloat(s.last.Value)
+
+	if !ok1 || !ok2 {
+		return !reflect.DeepEqual(v, s.last.Value)
+	}
+
+	d := math.Abs(nv - lv)
+
+	if d == 0 {
+		return false
+	}
+
+	if s.cfg.DeadbandAbs > 0 && d <= s.cfg.DeadbandAbs {
+		return false
+	}
+
+	if s.cfg.DeadbandPct > 0 && d <= math.Abs(lv)*s.cfg.DeadbandPct/100 {
+		return false
+	}
+
+	return true
+}
+
+// Re-emits the last value of every node with max_silence set, if no value was published for max_silence seconds
+// Heartbeats are only sent while the opc ua connection is active and carry the current time as timestamp
+func (f *ChangeFilter) RunHeartbeat(ctx context.Context, pub func(handlers.Payload)) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			if !con_active.Load() {
+				continue
+			}
+
+			for _, p := range f.silent() {
+				logging.Logger.Debug(fmt.Sprintf("sending heartbeat for node %s", p.Id), "func", "RunHeartbeat")
+				pub(p)
+			}
+		}
+	}
+}
+
+func (f *ChangeFilter) silent() []handlers.Payload {
+	f.Lock()
+	defer f.Unlock()
+
+	pay := make([]handlers.Payload, 0)
+
+	for _, s := range f.nodes {
+		if !s.valid || s.cfg.MaxSilence <= 0 {
+			continue
+		}
+
+		if time.Since(s.lastPub) < time.Duration(s.cfg.MaxSilence)*time.Second {
+			continue
+		}
+
+		s.lastPub = time.Now()
+
+		p := s.last
+		p.TS = s.lastPub
+		p.Heartbeat = true
+		pay = append(pay, p)
+	}
+
+	return pay
+}
+
+func toFloat(i interface{}) (float64, bool) {
+	switch v := i.(type) {
+	case int:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"gualogger/handlers"
+	"testing"
+	"time"
+)
+
+type sample struct {
+	value  interface{}
+	status uint32
+	pass   bool
+}
+
+func TestChangeFilterPass(t *testing.T) {
+	const bad = 0x80000000
+
+	tests := []struct {
+		name    string
+		cfg     NodeConfig
+		samples []sample
+	}{
+		{"no filter settings", NodeConfig{}, []sample{{1.0, 0, true}, {1.0, 0, true}}},
+		{"unchanged value", NodeConfig{MaxSilence: 60}, []sample{{1.0, 0, true}, {1.0, 0, false}, {1.5, 0, true}}},
+		{"absolute deadband", NodeConfig{DeadbandAbs: 1}, []sample{{10.0, 0, true}, {10.5, 0, false}, {11.0, 0, false}, {11.2, 0, true}, {11.9, 0, false}}},
+		{"percent of last published value", NodeConfig{DeadbandPct: 10}, []sample{{100.0, 0, true}, {105.0, 0, false}, {111.0, 0, true}, {120.0, 0, false}, {122.2, 0, true}}},
+		{"percent of negative value", NodeConfig{DeadbandPct: 10}, []sample{{-100.0, 0, true}, {-95.0, 0, false}, {-89.0, 0, true}}},
+		{"both deadbands must be exceeded", NodeConfig{DeadbandAbs: 1, DeadbandPct: 10}, []sample{{100.0, 0, true}, {102.0, 0, false}, {111.0, 0, true}, {5.0, 0, true}, {5.8, 0, false}, {6.2, 0, true}}},
+		{"integer values", NodeConfig{DeadbandAbs: 2}, []sample{{int32(10), 0, true}, {int32(12), 0, false}, {int32(13), 0, true}}},
+		{"status change within deadband", NodeConfig{DeadbandAbs: 1}, []sample{{10.0, 0, true}, {10.0, bad, true}, {10.0, bad, false}, {10.2, 0, true}}},
+		{"non numeric values", NodeConfig{DeadbandAbs: 1}, []sample{{"a", 0, true}, {"a", 0, false}, {"b", 0, true}}},
+	}
+
+	for _, tc := range tests {
+		tc.cfg.NodeID = "ns=2;s=Tag1"
+		f := NewChangeFilter([]NodeConfig{tc.cfg})
+
+		for i, s := range tc.samples {
+			p := handlers.Payload{Id: nodeKey(tc.cfg.NodeID), Value: s.value, Status: s.status}
+
+			if got := f.Pass(p); got != s.pass {
+				t.Errorf("%s: sample %d (%v) passed %t, want %t", tc.name, i, s.value, got, s.pass)
+			}
+		}
+	}
+}
+
+// Heartbeats repeat the last value and must not be counted by the aggregator
+func TestHeartbeatNotAggregated(t *testing.T) {
+	f := NewChangeFilter([]NodeConfig{{NodeID: "ns=2;s=Tag1", MaxSilence: 1}})
+	f.Pass(handlers.Payload{Id: "ns=2;s=Tag1", Value: 1.0, Quality: handlers.QualityGood})
+
+	// pretend the last value was published before max_silence
+	f.nodes["ns=2;s=Tag1"].lastPub = f.nodes["ns=2;s=Tag1"].lastPub.Add(-2 * time.Second)
+
+	pay := f.silent()
+
+	if len(pay) != 1 || !pay[0].Heartbeat {
+		t.Fatalf("expected one heartbeat payload, got %v", pay)
+	}
+
+	a := NewAggregator(&AggregationConfig{Interval: 60, Nodeids: []string{"ns=2;s=Tag1"}})
+	a.Add(handlers.Payload{Id: "ns=2;s=Tag1", Value: 1.0, Quality: handlers.QualityGood})
+
+	a.Add(pay[0])
+
+	if agg := a.Flush(time.Now()); len(agg) != 1 || agg[0].Count != 1 {
+		t.Errorf("heartbeat was aggregated: %v", agg)
+	}
+}
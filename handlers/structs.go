@@ -5,17 +5,80 @@ import (
 	"time"
 )
 
+// Value of a node, arrays and matrices are exported as (nested) JSON arrays with their dimensions
+// Samples with a bad or uncertain status are exported as well, Quality holds the category of Status
 type Payload struct {
-	Value    interface{} `json:"value"`
-	TS       time.Time   `json:"ts"`
+	Value      interface{} `json:"value"`
+	Dimensions []int32     `json:"dimensions,omitempty"`
+	TS         time.Time   `json:"ts"`
+	ServerTS   time.Time   `json:"server_ts"`
+	Status     uint32      `json:"status"`
+	Quality    string      `json:"quality"`
+	Name       string      `json:"name"`
+	Id         string      `json:"id"`
+	Datatype   string      `json:"datatype"`
+	Server     string      `json:"server"`
+	Backfill   bool        `json:"backfill"`
+	SourceTS   time.Time   `json:"-"` // source timestamp of the sample regardless of the selected TS
+	Heartbeat  bool        `json:"-"` // re-emitted last value, not a new sample
+	Meta       *NodeMeta   `json:"meta,omitempty"`
+}
+
+// Quality categories of a status code
+const (
+	QualityGood      = "good"
+	QualityUncertain = "uncertain"
+	QualityBad       = "bad"
+)
+
+// Metadata of a monitored node read from the server on connect
+// Unit and range are only set for analog items providing EngineeringUnits and EURange
+type NodeMeta struct {
+	DisplayName string   `json:"display_name"`
+	BrowseName  string   `json:"browse_name"`
+	BrowsePath  string   `json:"browse_path"`
+	Description string   `json:"description"`
+	Unit        string   `json:"unit,omitempty"`
+	RangeLow    *float64 `json:"range_low,omitempty"`
+	RangeHigh   *float64 `json:"range_high,omitempty"`
+}
+
+// Aggregated values of a single node over one time window
+// Min, Max and Mean are only set for numeric values
+type AggregatePayload struct {
+	Start    time.Time   `json:"start"`
+	End      time.Time   `json:"end"`
+	Min      *float64    `json:"min"`
+	Max      *float64    `json:"max"`
+	Mean     *float64    `json:"mean"`
+	Count    int         `json:"count"`
+	First    interface{} `json:"first"`
+	Last     interface{} `json:"last"`
 	Name     string      `json:"name"`
 	Id       string      `json:"id"`
 	Datatype string      `json:"datatype"`
 	Server   string      `json:"server"`
 }
 
+// Alarm or condition event received from an event notifier
+// Active and Acked are only set for condition types providing those states
+type EventPayload struct {
+	EventId    string    `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	SourceName string    `json:"source_name"`
+	Message    string    `json:"message"`
+	Severity   uint16    `json:"severity"`
+	Active     *bool     `json:"active"`
+	Acked      *bool     `json:"acked"`
+	TS         time.Time `json:"ts"`
+	Notifier   string    `json:"notifier"`
+	Server     string    `json:"server"`
+}
+
 type Exporter interface {
 	Initialize(ctx context.Context, callback func(context.Context) []Payload) error
 	Publish(ctx context.Context, p Payload) error
+	PublishAggregate(ctx context.Context, a AggregatePayload) error
+	PublishEvent(ctx context.Context, e EventPayload) error
 	Shutdown(ctx context.Context) error
 }
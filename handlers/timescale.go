@@ -2,7 +2,10 @@ package handlers
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -35,7 +38,7 @@ func (t *TimeScaleDB) Initialize(ctx context.Context, cb func(context.Context) [
 	sql := `CREATE TABLE IF NOT EXISTS ` + t.Table
 
 	sql += ` (
-		value    TEXT NOT NULL,
+		value    TEXT,
 		ts       TIMESTAMPTZ NOT NULL,
 		name     TEXT NOT NULL,
 		id       TEXT NOT NULL,
@@ -57,6 +60,100 @@ func (t *TimeScaleDB) Initialize(ctx context.Context, cb func(context.Context) [
 		return err
 	}
 
+	sql = fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS backfill BOOLEAN NOT NULL DEFAULT FALSE", t.Table)
+
+	_, err = t.Pool.Exec(ctx, sql)
+
+	if err != nil {
+		return err
+	}
+
+	// arrays and structured values are additionally stored as jsonb
+	sql = fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS value_json JSONB, ADD COLUMN IF NOT EXISTS dimensions INTEGER[]", t.Table)
+
+	_, err = t.Pool.Exec(ctx, sql)
+
+	if err != nil {
+		return err
+	}
+
+	// samples without value are stored as NULL, tables created by earlier versions require a value
+	sql = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN value DROP NOT NULL", t.Table)
+
+	_, err = t.Pool.Exec(ctx, sql)
+
+	if err != nil {
+		return err
+	}
+
+	sql = fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS status BIGINT NOT NULL DEFAULT 0, ADD COLUMN IF NOT EXISTS quality TEXT NOT NULL DEFAULT 'good', ADD COLUMN IF NOT EXISTS server_ts TIMESTAMPTZ", t.Table)
+
+	_, err = t.Pool.Exec(ctx, sql)
+
+	if err != nil {
+		return err
+	}
+
+	sql = `CREATE TABLE IF NOT EXISTS ` + t.Table + `_agg`
+
+	sql += ` (
+		ts       TIMESTAMPTZ NOT NULL,
+		ts_end   TIMESTAMPTZ NOT NULL,
+		min      DOUBLE PRECISION,
+		max      DOUBLE PRECISION,
+		mean     DOUBLE PRECISION,
+		count    INTEGER NOT NULL,
+		first    TEXT NOT NULL,
+		last     TEXT NOT NULL,
+		name     TEXT NOT NULL,
+		id       TEXT NOT NULL,
+		datatype TEXT NOT NULL,
+		server   TEXT NOT NULL
+		);`
+
+	_, err = t.Pool.Exec(ctx, sql)
+
+	if err != nil {
+		return err
+	}
+
+	sql = fmt.Sprintf("SELECT create_hypertable('%s_agg', by_range('ts'), if_not_exists => TRUE)", t.Table)
+
+	_, err = t.Pool.Exec(ctx, sql)
+
+	if err != nil {
+		return err
+	}
+
+	sql = `CREATE TABLE IF NOT EXISTS ` + t.Table + `_events`
+
+	sql += ` (
+		ts          TIMESTAMPTZ NOT NULL,
+		event_id    TEXT NOT NULL,
+		event_type  TEXT NOT NULL,
+		source_name TEXT NOT NULL,
+		message     TEXT NOT NULL,
+		severity    INTEGER NOT NULL,
+		active      BOOLEAN,
+		acked       BOOLEAN,
+		notifier    TEXT NOT NULL,
+		server      TEXT NOT NULL
+		);`
+
+	_, err = t.Pool.Exec(ctx, sql)
+
+	if err != nil {
+		return err
+	}
+
+	sql = fmt.Sprintf("SELECT create_hypertable('%s_events', by_range('ts'), if_not_exists => TRUE)", t.Table)
+
+	_, err = t.Pool.Exec(ctx, sql)
+
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -66,9 +163,74 @@ func (t *TimeScaleDB) Initialize(ctx context.Context, cb func(context.Context) [
 
 func (t *TimeScaleDB) Publish(ctx context.Context, p Payload) error {
 
-	sql := fmt.Sprintf("INSERT INTO %s (value, ts, name, id, datatype, server) VALUES ($1, $2, $3, $4, $5, $6)", t.Table)
+	sql := fmt.Sprintf("INSERT INTO %s (value, ts, name, id, datatype, server, backfill, value_json, dimensions, status, quality, server_ts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)", t.Table)
+
+	val, js, err := valueColumns(p.Value)
 
-	args := []any{fmt.Sprint(p.Value), p.TS, p.Name, p.Id, p.Datatype, p.Server}
+	if err != nil {
+		return err
+	}
+
+	var sts *time.Time
+
+	if !p.ServerTS.IsZero() {
+		sts = &p.ServerTS
+	}
+
+	args := []any{val, p.TS, p.Name, p.Id, p.Datatype, p.Server, p.Backfill, js, p.Dimensions, p.Status, p.Quality, sts}
+
+	_, err = t.Pool.Exec(ctx, sql, args...)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Returns the text representation of a value and its json encoding for arrays and structured values
+// Missing values are returned as nil and stored as NULL, byte strings are stored base64 encoded like their json encoding
+func valueColumns(v interface{}) (*string, []byte, error) {
+	switch bs := v.(type) {
+	case nil:
+		// bad samples usually carry no value
+		return nil, nil, nil
+	case []byte:
+		s := base64.StdEncoding.EncodeToString(bs)
+		return &s, nil, nil
+	case []interface{}, map[string]interface{}:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		s := string(b)
+		return &s, b, nil
+	default:
+		s := fmt.Sprint(v)
+		return &s, nil, nil
+	}
+}
+
+func (t *TimeScaleDB) PublishAggregate(ctx context.Context, a AggregatePayload) error {
+
+	sql := fmt.Sprintf("INSERT INTO %s_agg (ts, ts_end, min, max, mean, count, first, last, name, id, datatype, server) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)", t.Table)
+
+	args := []any{a.Start, a.End, a.Min, a.Max, a.Mean, a.Count, fmt.Sprint(a.First), fmt.Sprint(a.Last), a.Name, a.Id, a.Datatype, a.Server}
+
+	_, err := t.Pool.Exec(ctx, sql, args...)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *TimeScaleDB) PublishEvent(ctx context.Context, e EventPayload) error {
+
+	sql := fmt.Sprintf("INSERT INTO %s_events (ts, event_id, event_type, source_name, message, severity, active, acked, notifier, server) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)", t.Table)
+
+	args := []any{e.TS, e.EventId, e.EventType, e.SourceName, e.Message, int(e.Severity), e.Active, e.Acked, e.Notifier, e.Server}
 
 	_, err := t.Pool.Exec(ctx, sql, args...)
 
@@ -80,6 +242,9 @@ func (t *TimeScaleDB) Publish(ctx context.Context, p Payload) error {
 }
 
 func (t *TimeScaleDB) Shutdown(ctx context.Context) error {
+	if t.Pool == nil {
+		return nil
+	}
 	t.Pool.Close()
 	return nil
 }
@@ -3,6 +3,8 @@ package handlers
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"gualogger/logging"
 	"net/http"
@@ -20,6 +22,7 @@ type Websocket struct {
 	Username string `mapstruct:"username"`
 	Password string `mapstruct:"password"`
 	manager  manager
+	server   *http.Server
 }
 
 var (
@@ -30,11 +33,18 @@ var (
 			return true
 		},
 	}
-	pongDeadline = 10 * time.Second
-	pingInterval = (pongDeadline * 9) / 10
-	callback     func(context.Context) []Payload
+	pongDeadline  = 10 * time.Second
+	nodeTimeout   = 30 * time.Second
+	pingInterval  = (pongDeadline * 9) / 10
+	closeDeadline = time.Second
+	callback      func(context.Context) []Payload
+	addNodes      nodeCallback
+	removeNodes   nodeCallback
 )
 
+// Changes the monitored nodes, returns the failed node ids with their error message
+type nodeCallback func(context.Context, []string) map[string]string
+
 type manager struct {
 	sync.RWMutex
 	clients map[*client]bool
@@ -45,13 +55,38 @@ type client struct {
 	addedTS    time.Time
 	connection *websocket.Conn
 	manager    *manager
+	wmu        sync.Mutex
+}
+
+// Outbound aggregate or event message, raw values are sent as plain payloads without envelope
+type outbound_event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
 }
 
+// Types of outbound messages
+const (
+	msgAggregate = "aggregate"
+	msgEvent     = "event"
+)
+
 type inbound_event struct {
 	Name    string `json:"name"`
 	Payload string `json:"payload"`
 }
 
+// Answer to add_nodes and remove_nodes messages, Error is set if the message itself was invalid
+type node_result struct {
+	Name   string            `json:"name"`
+	Error  string            `json:"error,omitempty"`
+	Errors map[string]string `json:"errors"`
+}
+
+// Sets the callbacks of the add_nodes and remove_nodes messages, their payload is a json array of node ids
+func SetNodeCallbacks(add, remove func(context.Context, []string) map[string]string) {
+	addNodes, removeNodes = add, remove
+}
+
 func (ws *Websocket) Initialize(ctx context.Context, cb func(context.Context) []Payload) error {
 
 	str := fmt.Sprintf("%s:%s", ws.Username, ws.Password)
@@ -72,7 +107,9 @@ func (ws *Websocket) Initialize(ctx context.Context, cb func(context.Context) []
 
 	go ws.manager.verifyClients()
 
-	go startServer(ws.Port)
+	ws.server = &http.Server{Addr: fmt.Sprintf(":%d", ws.Port)}
+
+	go ws.startServer()
 
 	return nil
 }
@@ -81,12 +118,36 @@ func (ws *Websocket) Publish(ctx context.Context, p Payload) error {
 
 	var e error
 
-	for c, auth := range ws.manager.clients {
+	for _, c := range ws.manager.authenticatedClients() {
+		if err := c.writeJSON(p); err != nil {
+			e = err
+			continue
+		}
+	}
+
+	return e
+}
+
+func (ws *Websocket) PublishAggregate(ctx context.Context, a AggregatePayload) error {
+
+	var e error
 
-		if !auth {
+	for _, c := range ws.manager.authenticatedClients() {
+		if err := c.writeJSON(outbound_event{Type: msgAggregate, Data: a}); err != nil {
+			e = err
 			continue
 		}
-		if err := c.connection.WriteJSON(p); err != nil {
+	}
+
+	return e
+}
+
+func (ws *Websocket) PublishEvent(ctx context.Context, ev EventPayload) error {
+
+	var e error
+
+	for _, c := range ws.manager.authenticatedClients() {
+		if err := c.writeJSON(outbound_event{Type: msgEvent, Data: ev}); err != nil {
 			e = err
 			continue
 		}
@@ -95,8 +156,29 @@ func (ws *Websocket) Publish(ctx context.Context, p Payload) error {
 	return e
 }
 
+// Closes all clients with a going away close frame and stops the http server
 func (ws *Websocket) Shutdown(ctx context.Context) error {
-	return nil
+
+	ws.manager.Lock()
+
+	for c := range ws.manager.clients {
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+
+		if err := c.connection.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeDeadline)); err != nil {
+			logging.Logger.Warn(fmt.Sprintf("unable to write close message: %s", err.Error()), "func", "websocket_shutdown")
+		}
+
+		c.connection.Close()
+		delete(ws.manager.clients, c)
+	}
+
+	ws.manager.Unlock()
+
+	if ws.server == nil {
+		return nil
+	}
+
+	return ws.server.Shutdown(ctx)
 }
 
 func (ws *Websocket) upgrade(w http.ResponseWriter, r *http.Request) {
@@ -119,11 +201,9 @@ func (ws *Websocket) upgrade(w http.ResponseWriter, r *http.Request) {
 	go c.writeMessages()
 }
 
-func startServer(port int) {
-	addr := fmt.Sprintf(":%d", port)
-
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		logging.Logger.Error(fmt.Sprintf("unable to start websocket server on port %d: %s", port, err.Error()), "func", "websocket_startServer")
+func (ws *Websocket) startServer() {
+	if err := ws.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logging.Logger.Error(fmt.Sprintf("unable to start websocket server on port %d: %s", ws.Port, err.Error()), "func", "websocket_startServer")
 		os.Exit(100)
 	}
 }
@@ -158,6 +238,14 @@ func (c *client) readMessages() {
 				fmt.Println(p.Id, p.Value)
 			}
 
+		case "add_nodes", "remove_nodes":
+			if !c.manager.authenticated(c) {
+				return
+			}
+
+			// node changes take server round trips, reading continues to answer pings meanwhile
+			go c.changeNodes(inb)
+
 		default:
 			return
 		}
@@ -178,7 +266,7 @@ func (c *client) writeMessages() {
 
 		case <-tick.C:
 			// Send the Ping
-			if err := c.connection.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			if err := c.writeMessage(websocket.PingMessage, []byte{}); err != nil {
 				logging.Logger.Warn(fmt.Sprintf("unable to write ping message: %s", err.Error()), "func", "websocket_writemessages")
 				return
 			}
@@ -187,15 +275,76 @@ func (c *client) writeMessages() {
 	}
 }
 
+// Applies an add_nodes or remove_nodes message and answers with the failed node ids
+// Invalid messages are answered with an error instead of dropping the client
+func (c *client) changeNodes(inb inbound_event) {
+	res := node_result{Name: inb.Name + "_result", Errors: map[string]string{}}
+
+	var ids []string
+
+	cb := addNodes
+	if inb.Name == "remove_nodes" {
+		cb = removeNodes
+	}
+
+	if err := json.Unmarshal([]byte(inb.Payload), &ids); err != nil {
+		res.Error = fmt.Sprintf("invalid payload, expected a json array of node ids: %s", err.Error())
+	} else if cb == nil {
+		res.Error = "changing nodes is not supported"
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), nodeTimeout)
+		res.Errors = cb(ctx, ids)
+		cancel()
+	}
+
+	if err := c.writeJSON(res); err != nil {
+		logging.Logger.Warn(fmt.Sprintf("unable to write %s: %s", res.Name, err.Error()), "func", "websocket_changenodes")
+	}
+}
+
+// Writes a json message, a connection only supports one concurrent writer
+func (c *client) writeJSON(v interface{}) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.connection.WriteJSON(v)
+}
+
+func (c *client) writeMessage(t int, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.connection.WriteMessage(t, data)
+}
+
+// Returns a snapshot of the authenticated clients, publishing must not iterate the map while clients are added or removed
+func (m *manager) authenticatedClients() []*client {
+	m.RLock()
+	defer m.RUnlock()
+
+	res := make([]*client, 0, len(m.clients))
+	for c, auth := range m.clients {
+		if auth {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+func (m *manager) authenticated(c *client) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.clients[c]
+}
+
 func (m *manager) authenticateClient(c *client) {
-	_, ok := m.clients[c]
+	m.Lock()
+	defer m.Unlock()
 
-	if ok {
-		m.Lock()
+	if _, ok := m.clients[c]; ok {
 		m.clients[c] = true
-		m.Unlock()
 	}
-
 }
 
 func (m *manager) removeClient(c *client) {
@@ -205,7 +354,7 @@ func (m *manager) removeClient(c *client) {
 	_, ok := m.clients[c]
 
 	if ok {
-		c.connection.WriteMessage(websocket.CloseMessage, []byte(""))
+		c.writeMessage(websocket.CloseMessage, []byte(""))
 		c.connection.Close()
 		delete(m.clients, c)
 
@@ -216,13 +365,18 @@ func (m *manager) removeClient(c *client) {
 
 func (m *manager) verifyClients() {
 	for {
+		m.RLock()
+		expired := make([]*client, 0)
 		for c, auth := range m.clients {
-
 			if !auth && time.Since(c.addedTS) > 10*time.Second {
-				logging.Logger.Info("websocket client was unable to authenticate in the specified timeframe - removing client", "func", "websocket_verifyclients")
-				m.removeClient(c)
+				expired = append(expired, c)
 			}
+		}
+		m.RUnlock()
 
+		for _, c := range expired {
+			logging.Logger.Info("websocket client was unable to authenticate in the specified timeframe - removing client", "func", "websocket_verifyclients")
+			m.removeClient(c)
 		}
 
 		time.Sleep(30 * time.Second)
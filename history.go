@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gualogger/handlers"
+	"gualogger/logging"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Last received source timestamp per node, used as start of the backfill window after a reconnect
+var lastSeen = struct {
+	sync.Mutex
+	ts map[string]time.Time
+}{ts: make(map[string]time.Time)}
+
+// Records the source timestamp of a received value
+func MarkSeen(id string, ts time.Time) {
+	lastSeen.Lock()
+	defer lastSeen.Unlock()
+
+	if ts.After(lastSeen.ts[id]) {
+		lastSeen.ts[id] = ts
+	}
+}
+
+// Reads the values of all previously seen nodes between their last timestamp and end from the servers history
+// and publishes them marked as backfilled. Servers without history support are skipped.
+func Backfill(ctx context.Context, c *opcua.Client, end time.Time) {
+
+	lastSeen.Lock()
+	start := make(map[string]time.Time, len(lastSeen.ts))
+	for k, v := range lastSeen.ts {
+		start[k] = v
+	}
+	lastSeen.Unlock()
+
+	count := 0
+
+	for n, ts := range start {
+		id, ok := resolver.NodeID(n)
+
+		if !ok {
+			continue
+		}
+
+		nodes := []*ua.HistoryReadValueID{{NodeID: id, DataEncoding: &ua.QualifiedName{}}}
+
+		for len(nodes) > 0 {
+			res, err := c.HistoryReadRawModified(ctx, nodes, &ua.ReadRawModifiedDetails{StartTime: ts, EndTime: end})
+
+			if err != nil {
+				logging.Logger.Error(fmt.Sprintf("error during history read for node %s: %s", n, err.Error()), "func", "Backfill")
+				break
+			}
+
+			if len(res.Results) == 0 {
+				break
+			}
+
+			r := res.Results[0]
+
+			if r.StatusCode == ua.StatusBadHistoryOperationUnsupported || r.StatusCode == ua.StatusBadServiceUnsupported {
+				logging.Logger.Warn("server does not support history read - skipping backfill", "func", "Backfill")
+				return
+			}
+
+			if r.StatusCode != ua.StatusOK {
+				logging.Logger.Warn(fmt.Sprintf("history read for node %s returned status %s", n, r.StatusCode), "func", "Backfill")
+				break
+			}
+
+			var h *ua.HistoryData
+
+			if r.HistoryData != nil {
+				h, _ = r.HistoryData.Value.(*ua.HistoryData)
+			}
+
+			if h != nil {
+				for _, v := range h.DataValues {
+					// the start time is inclusive and has already been published
+					if !v.SourceTimestamp.After(ts) {
+						continue
+					}
+
+					p := NewPayload(n, id, v, time.Time{})
+					p.Backfill = true
+
+					// bad samples may be stamped while the source was unavailable, only good ones narrow the next window
+					if p.Quality == handlers.QualityGood {
+						MarkSeen(p.Id, p.SourceTS)
+					}
+
+					if filter.Pass(p) {
+						mgr.Publish(ctx, p)
+						count++
+					}
+				}
+			}
+
+			if len(r.ContinuationPoint) == 0 {
+				break
+			}
+
+			nodes[0].ContinuationPoint = r.ContinuationPoint
+		}
+	}
+
+	logging.Logger.Info(fmt.Sprintf("backfilled %d values from server history", count), "func", "Backfill")
+}
@@ -2,11 +2,26 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"gualogger/handlers"
 	"gualogger/logging"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// Exit codes of gualogger
+const (
+	exitOK         = 0
+	exitConnection = 1
+	exitShutdown   = 2
+)
+
+// Time granted to drain and shut down the exporters after SIGINT or SIGTERM
+const shutdownTimeout = 20 * time.Second
+
 var (
 	conf *Configuration
 	mgr  *ExportManager
@@ -18,24 +33,84 @@ func init() {
 
 	logging.InitLogger(l)
 
+}
+
+func main() {
 	var err error
 
+	// the configuration is loaded in main instead of init, so tests of this package run without a config file
 	conf, err = LoadConfig()
 
 	if err != nil {
-		logging.Logger.Error(fmt.Sprintf("error while loading configuration: %s", err.Error()), "func", "init")
+		logging.Logger.Error(fmt.Sprintf("error while loading configuration: %s", err.Error()), "func", "main")
 		os.Exit(1)
 	}
 
-}
+	if len(os.Args) > 1 && os.Args[1] == "cert" {
+		os.Exit(RunCertCommand(os.Args[2:]))
+	}
 
-func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	mgr = NewManager(&conf.Exporters, &conf.ExpMap)
 	if err := mgr.SetupPubHandlers(ctx); err != nil {
 		logging.Logger.Error(err.Error(), "func", "main")
 	}
 
-	conf.Opcua.InitSuperVisor(ctx)
+	mgr.SetAggregator(ctx, NewAggregator(&conf.Aggregation))
+
+	filter = NewChangeFilter(conf.Opcua.Subscription.NodeConfigs())
+	timestamps = NewTimestampSelector(&conf.Opcua.Subscription)
+	nodeset = NewNodeSet(&conf.Opcua.Subscription)
+
+	handlers.SetNodeCallbacks(
+		func(ctx context.Context, ids []string) map[string]string {
+			return errMessages(nodeset.Add(ctx, ids, nil))
+		},
+		func(ctx context.Context, ids []string) map[string]string {
+			return errMessages(nodeset.Remove(ctx, ids))
+		},
+	)
+
+	go RunReloadHook(ctx)
+	go RunAPI(ctx, &conf.Api)
+
+	go filter.RunHeartbeat(ctx, func(p handlers.Payload) {
+		mgr.Publish(ctx, p)
+	})
+
+	for i := range conf.Opcua.Subscription.Groups {
+		if conf.Opcua.Subscription.Groups[i].Mode == GroupModePoll {
+			go RunPollGroup(ctx, &conf.Opcua.Subscription.Groups[i])
+		}
+	}
+
+	go conf.Opcua.Connection.RunCertRenewal(ctx)
+
+	code := exitOK
+
+	if err := conf.Opcua.InitSuperVisor(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		logging.Logger.Error(fmt.Sprintf("connection supervisor stopped: %s", err.Error()), "func", "main")
+		code = exitConnection
+	}
+
+	stop()
+
+	logging.Logger.Info("shutting down", "func", "main")
+
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+
+	if err := mgr.Shutdown(sctx); err != nil {
+		logging.Logger.Error(fmt.Sprintf("shutdown incomplete: %s", err.Error()), "func", "main")
+		if code == exitOK {
+			code = exitShutdown
+		}
+	}
+
+	cancel()
+
+	logging.Logger.Info(fmt.Sprintf("shutdown complete - exit code %d", code), "func", "main")
+
+	os.Exit(code)
 }
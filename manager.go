@@ -2,19 +2,35 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"gualogger/handlers"
 	"gualogger/logging"
+	"sync"
+	"time"
 )
 
+// Publishes hold the read lock while they are in flight, Shutdown takes the write lock to drain them
 type ExportManager struct {
-	exporters map[string]handlers.Exporter
+	sync.RWMutex
+	exporters  map[string]handlers.Exporter
+	streams    map[string]string
+	aggregator *Aggregator
+	closed     bool
 }
 
+// Data streams an exporter can receive, configured with the `data` key of each exporter
+const (
+	StreamRaw       = "raw"
+	StreamAggregate = "aggregate"
+	StreamBoth      = "both"
+)
+
 // Initializes a new manager instance
 func NewManager(e *Exporters, emap *map[string]interface{}) *ExportManager {
 	m := new(ExportManager)
 	m.exporters = make(map[string]handlers.Exporter, 0)
+	m.streams = make(map[string]string, 0)
 	m.RegisterExporters(e, emap)
 	return m
 }
@@ -22,15 +38,51 @@ func NewManager(e *Exporters, emap *map[string]interface{}) *ExportManager {
 // Adds exporters to the manager based on entries in the exporter config structure
 func (m *ExportManager) RegisterExporters(e *Exporters, emap *map[string]interface{}) {
 	reg := e.GetExporterRegister()
-	for k := range *emap {
+	for k, v := range *emap {
 		h, exists := reg[k]
 		if exists {
 			logging.Logger.Info(fmt.Sprintf("registered exporter: %s", k), "func", "RegisterExporters")
 			m.exporters[k] = h
+			m.streams[k] = exporterStream(k, v)
 		}
 	}
 }
 
+// Reads the `data` key of an exporter config, defaults to raw
+func exporterStream(name string, v interface{}) string {
+	c, ok := v.(map[string]interface{})
+
+	if !ok {
+		return StreamRaw
+	}
+
+	s, _ := c["data"].(string)
+
+	switch s {
+	case "":
+		return StreamRaw
+	case StreamRaw, StreamAggregate, StreamBoth:
+		return s
+	default:
+		logging.Logger.Warn(fmt.Sprintf("unknown data stream %s for exporter %s - falling back to raw", s, name), "func", "RegisterExporters")
+		return StreamRaw
+	}
+}
+
+// Attaches an aggregator to the manager, raw values of aggregated nodes are collected and
+// published as aggregates to all exporters with data set to aggregate or both
+func (m *ExportManager) SetAggregator(ctx context.Context, a *Aggregator) {
+	if a == nil {
+		return
+	}
+
+	m.aggregator = a
+
+	go a.Run(ctx, func(p handlers.AggregatePayload) {
+		m.PublishAggregate(ctx, p)
+	})
+}
+
 // Setup exporter by calling the Initialize() function of each exporters interface
 // If the initialization of one exporter fails, the first error gets returned
 func (m *ExportManager) SetupPubHandlers(ctx context.Context) error {
@@ -50,12 +102,136 @@ func (m *ExportManager) SetupPubHandlers(ctx context.Context) error {
 	return nil
 }
 
+// Publishes a raw value to all exporters receiving raw data
+// Exporters receiving only aggregates still get the raw values of nodes that are not aggregated
+// and backfilled values, which belong to windows that are already closed
 func (m *ExportManager) Publish(ctx context.Context, p handlers.Payload) {
+	if !m.acquire() {
+		return
+	}
+	defer m.RUnlock()
+
+	// exporter writes are not aborted by the shutdown signal, Shutdown waits for them instead
+	ctx = context.WithoutCancel(ctx)
+
+	p.Server = conf.Opcua.Connection.Endpoint
+
+	metadata.Apply(&p, conf.Opcua.Subscription.NameSource)
+
+	if !conf.Opcua.Subscription.Flatten {
+		m.publish(ctx, p)
+		return
+	}
+
+	for _, f := range flattenPayload(p) {
+		m.publish(ctx, f)
+	}
+}
+
+// Publishes a single payload to the exporters and the aggregator, the caller holds the read lock
+func (m *ExportManager) publish(ctx context.Context, p handlers.Payload) {
+	agg := m.aggregator.Selected(p.Id)
+
 	for n, e := range m.exporters {
-		p.Server = conf.Opcua.Connection.Endpoint
+		if agg && !p.Backfill && m.streams[n] == StreamAggregate {
+			continue
+		}
 
 		if err := e.Publish(ctx, p); err != nil {
 			logging.Logger.Error(fmt.Sprintf("failed to publish payload for exporter %s: %s", n, err.Error()), "func", "Publish")
 		}
 	}
+
+	if agg {
+		m.aggregator.Add(p)
+	}
+}
+
+// Publishes an aggregate to all exporters receiving aggregated data
+func (m *ExportManager) PublishAggregate(ctx context.Context, a handlers.AggregatePayload) {
+	if !m.acquire() {
+		return
+	}
+	defer m.RUnlock()
+
+	ctx = context.WithoutCancel(ctx)
+
+	for n, e := range m.exporters {
+		if m.streams[n] == StreamRaw {
+			continue
+		}
+
+		if err := e.PublishAggregate(ctx, a); err != nil {
+			logging.Logger.Error(fmt.Sprintf("failed to publish aggregate for exporter %s: %s", n, err.Error()), "func", "PublishAggregate")
+		}
+	}
+}
+
+// Publishes an alarm or condition event to all exporters
+func (m *ExportManager) PublishEvent(ctx context.Context, e handlers.EventPayload) {
+	if !m.acquire() {
+		return
+	}
+	defer m.RUnlock()
+
+	ctx = context.WithoutCancel(ctx)
+
+	e.Server = conf.Opcua.Connection.Endpoint
+
+	for n, exp := range m.exporters {
+		if err := exp.PublishEvent(ctx, e); err != nil {
+			logging.Logger.Error(fmt.Sprintf("failed to publish event for exporter %s: %s", n, err.Error()), "func", "PublishEvent")
+		}
+	}
+}
+
+// Takes the read lock for a publish, returns false without holding the lock once the manager is shut down
+func (m *ExportManager) acquire() bool {
+	m.RLock()
+
+	if m.closed {
+		m.RUnlock()
+		return false
+	}
+
+	return true
+}
+
+// Publishes the open aggregation windows, waits for in-flight publishes and shuts down all exporters
+// Publishes still running when ctx expires are abandoned, the errors of all exporters are returned joined
+func (m *ExportManager) Shutdown(ctx context.Context) error {
+
+	if m.aggregator != nil {
+		for _, a := range m.aggregator.Flush(time.Now()) {
+			m.PublishAggregate(ctx, a)
+		}
+	}
+
+	drained := make(chan struct{})
+
+	go func() {
+		m.Lock()
+		m.closed = true
+		m.Unlock()
+		close(drained)
+	}()
+
+	var errs []error
+
+	select {
+	case <-drained:
+		logging.Logger.Info("drained all in-flight publishes", "func", "Shutdown")
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("in-flight publishes not drained in time: %w", ctx.Err()))
+	}
+
+	for n, e := range m.exporters {
+		if err := e.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("error while shutting down exporter %s - %s", n, err.Error()))
+			continue
+		}
+		logging.Logger.Info(fmt.Sprintf("successfully shut down exporter: %s", n), "func", "Shutdown")
+	}
+
+	return errors.Join(errs...)
 }
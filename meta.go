@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gualogger/handlers"
+	"gualogger/logging"
+	"strings"
+	"sync"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Sources of Payload.Name, configured with the `name_source` key of the subscription
+const (
+	NameSourceNodeID      = "nodeid"
+	NameSourceDisplayName = "display_name"
+	NameSourceBrowsePath  = "browse_path"
+)
+
+// Maximum number of parents followed while building a browse path
+const maxBrowseDepth = 32
+
+// Metadata of the monitored nodes, loaded on every connect and attached to payloads by the export manager
+type MetaCache struct {
+	sync.RWMutex
+	nodes map[string]*handlers.NodeMeta
+}
+
+var metadata = NewMetaCache()
+
+func NewMetaCache() *MetaCache {
+	return &MetaCache{nodes: make(map[string]*handlers.NodeMeta)}
+}
+
+// Reads DisplayName, BrowseName, Description, browse path, EngineeringUnits and EURange of all resolved ids
+// Nodes whose attributes can not be read are reported and published without metadata
+func (m *MetaCache) Load(ctx context.Context, c *opcua.Client, ids []string) {
+
+	nodes := loadMeta(ctx, c, ids)
+
+	m.Lock()
+	m.nodes = nodes
+	m.Unlock()
+
+	logging.Logger.Info(fmt.Sprintf("loaded metadata of %d nodes", len(nodes)), "func", "LoadMetadata")
+}
+
+// Reads the metadata of ids in addition to the already cached nodes
+func (m *MetaCache) Add(ctx context.Context, c *opcua.Client, ids []string) {
+
+	nodes := loadMeta(ctx, c, ids)
+
+	m.Lock()
+	defer m.Unlock()
+
+	for k, meta := range nodes {
+		m.nodes[k] = meta
+	}
+}
+
+func loadMeta(ctx context.Context, c *opcua.Client, ids []string) map[string]*handlers.NodeMeta {
+
+	nodes := make(map[string]*handlers.NodeMeta, len(ids))
+	paths := make(map[string]string)
+
+	for _, n := range ids {
+		nid, ok := resolver.NodeID(n)
+
+		if !ok {
+			continue
+		}
+
+		meta, err := readMeta(ctx, c, nid, paths)
+
+		if err != nil {
+			logging.Logger.Warn(fmt.Sprintf("unable to read metadata of node %s: %s", n, err.Error()), "func", "LoadMetadata")
+			continue
+		}
+
+		nodes[nodeKey(n)] = meta
+	}
+
+	return nodes
+}
+
+// Returns the cached metadata of a node, nil if none is known
+func (m *MetaCache) Get(key string) *handlers.NodeMeta {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.nodes[key]
+}
+
+// Attaches the metadata to the payload and sets its name according to the configured name source
+// The name is left untouched if the requested attribute is not available
+func (m *MetaCache) Apply(p *handlers.Payload, source string) {
+	meta := m.Get(p.Id)
+
+	if meta == nil {
+		return
+	}
+
+	p.Meta = meta
+
+	switch source {
+	case NameSourceDisplayName:
+		if meta.DisplayName != "" {
+			p.Name = meta.DisplayName
+		}
+	case NameSourceBrowsePath:
+		if meta.BrowsePath != "" {
+			p.Name = meta.BrowsePath
+		}
+	}
+}
+
+func readMeta(ctx context.Context, c *opcua.Client, nid *ua.NodeID, paths map[string]string) (*handlers.NodeMeta, error) {
+
+	attrs, err := c.Node(nid).Attributes(ctx, ua.AttributeIDDisplayName, ua.AttributeIDBrowseName, ua.AttributeIDDescription)
+
+	if err != nil {
+		return nil, err
+	}
+
+	meta := new(handlers.NodeMeta)
+
+	if v, ok := attrValue(attrs, 0).(*ua.LocalizedText); ok {
+		meta.DisplayName = v.Text
+	}
+
+	if v, ok := attrValue(attrs, 1).(*ua.QualifiedName); ok {
+		meta.BrowseName = v.Name
+	}
+
+	if v, ok := attrValue(attrs, 2).(*ua.LocalizedText); ok {
+		meta.Description = v.Text
+	}
+
+	if p, err := browsePath(ctx, c, nid, meta.BrowseName, paths); err == nil {
+		meta.BrowsePath = p
+	} else {
+		logging.Logger.Warn(fmt.Sprintf("unable to build browse path of node %s: %s", nid, err.Error()), "func", "LoadMetadata")
+	}
+
+	if err := readEngineering(ctx, c, nid, meta); err != nil {
+		logging.Logger.Warn(fmt.Sprintf("unable to read engineering units of node %s: %s", nid, err.Error()), "func", "LoadMetadata")
+	}
+
+	return meta, nil
+}
+
+// Returns the value of the i-th attribute, nil if it could not be read
+func attrValue(attrs []*ua.DataValue, i int) interface{} {
+	if i >= len(attrs) || attrs[i].Status != ua.StatusOK || attrs[i].Value == nil {
+		return nil
+	}
+	return attrs[i].Value.Value()
+}
+
+// Reads the EngineeringUnits and EURange properties of an analog item, nodes without these properties are skipped
+func readEngineering(ctx context.Context, c *opcua.Client, nid *ua.NodeID, meta *handlers.NodeMeta) error {
+
+	refs, err := c.Node(nid).References(ctx, id.HasProperty, ua.BrowseDirectionForward, ua.NodeClassVariable, true)
+
+	if err != nil {
+		return err
+	}
+
+	props := make([]*ua.ReadValueID, 0, 2)
+
+	for _, r := range refs {
+		if r.BrowseName == nil || r.BrowseName.NamespaceIndex != 0 {
+			continue
+		}
+		if r.BrowseName.Name == "EngineeringUnits" || r.BrowseName.Name == "EURange" {
+			props = append(props, &ua.ReadValueID{NodeID: r.NodeID.NodeID, AttributeID: ua.AttributeIDValue})
+		}
+	}
+
+	if len(props) == 0 {
+		return nil
+	}
+
+	res, err := c.Read(ctx, &ua.ReadRequest{NodesToRead: props})
+
+	if err != nil {
+		return err
+	}
+
+	for _, r := range res.Results {
+		if r.Status != ua.StatusOK || r.Value == nil {
+			continue
+		}
+
+		eo, ok := r.Value.Value().(*ua.ExtensionObject)
+
+		if !ok {
+			continue
+		}
+
+		switch v := eo.Value.(type) {
+		case *ua.EUInformation:
+			if v.DisplayName != nil {
+				meta.Unit = v.DisplayName.Text
+			}
+		case *ua.Range:
+			low, high := v.Low, v.High
+			meta.RangeLow, meta.RangeHigh = &low, &high
+		}
+	}
+
+	return nil
+}
+
+// Builds the browse path from the Objects folder down to the node, e.g. Objects/Line1/Press3/Temperature
+// Paths of parents are memoized in paths so shared ancestors are only browsed once per load
+func browsePath(ctx context.Context, c *opcua.Client, nid *ua.NodeID, name string, paths map[string]string) (string, error) {
+
+	segments := []string{name}
+	chain := []*ua.NodeID{nid}
+
+	for i := 0; i < maxBrowseDepth; i++ {
+		cur := chain[0]
+
+		if p, ok := paths[cur.String()]; ok {
+			segments[0] = p
+			break
+		}
+
+		refs, err := c.Node(cur).References(ctx, id.HierarchicalReferences, ua.BrowseDirectionInverse, ua.NodeClassAll, true)
+
+		if err != nil {
+			return "", err
+		}
+
+		if len(refs) == 0 || refs[0].NodeID == nil || refs[0].BrowseName == nil {
+			break
+		}
+
+		parent := refs[0].NodeID.NodeID
+
+		if parent.Namespace() == 0 && parent.IntID() == id.RootFolder {
+			break
+		}
+
+		segments = append([]string{refs[0].BrowseName.Name}, segments...)
+		chain = append([]*ua.NodeID{parent}, chain...)
+	}
+
+	for i, n := range chain {
+		paths[n.String()] = strings.Join(segments[:i+1], "/")
+	}
+
+	return paths[nid.String()], nil
+}
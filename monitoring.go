@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// Returns a copy of m with all values set in o taking precedence
+func (m MonitoringConfig) Merge(o *MonitoringConfig) MonitoringConfig {
+	if o == nil {
+		return m
+	}
+
+	if o.SamplingInterval != nil {
+		m.SamplingInterval = o.SamplingInterval
+	}
+	if o.QueueSize != 0 {
+		m.QueueSize = o.QueueSize
+	}
+	if o.DiscardOldest != nil {
+		m.DiscardOldest = o.DiscardOldest
+	}
+	if o.Trigger != "" {
+		m.Trigger = o.Trigger
+	}
+	if o.DeadbandType != "" {
+		m.DeadbandType = o.DeadbandType
+		m.DeadbandValue = o.DeadbandValue
+	}
+
+	return m
+}
+
+// Converts the settings into opc ua monitoring parameters
+// Defaults are a sampling interval of 0 (fastest), a queue size of 1 and discarding the oldest value.
+// A DataChangeFilter is only attached if a trigger or deadband type is configured
+func (m MonitoringConfig) Parameters() (*ua.MonitoringParameters, error) {
+
+	p := &ua.MonitoringParameters{QueueSize: 1, DiscardOldest: true}
+
+	if m.SamplingInterval != nil {
+		p.SamplingInterval = *m.SamplingInterval
+	}
+	if m.QueueSize != 0 {
+		p.QueueSize = m.QueueSize
+	}
+	if m.DiscardOldest != nil {
+		p.DiscardOldest = *m.DiscardOldest
+	}
+
+	if m.Trigger == "" && m.DeadbandType == "" {
+		return p, nil
+	}
+
+	f := &ua.DataChangeFilter{Trigger: ua.DataChangeTriggerStatusValue}
+
+	switch m.Trigger {
+	case "", "StatusValue":
+	case "Status":
+		f.Trigger = ua.DataChangeTriggerStatus
+	case "StatusValueTimestamp":
+		f.Trigger = ua.DataChangeTriggerStatusValueTimestamp
+	default:
+		return nil, fmt.Errorf("unknown data change trigger %s", m.Trigger)
+	}
+
+	switch m.DeadbandType {
+	case "", "None":
+	case "Absolute":
+		f.DeadbandType = uint32(ua.DeadbandTypeAbsolute)
+		f.DeadbandValue = m.DeadbandValue
+	case "Percent":
+		if m.DeadbandValue < 0 || m.DeadbandValue > 100 {
+			return nil, fmt.Errorf("percent deadband must be between 0 and 100 - got %f", m.DeadbandValue)
+		}
+		f.DeadbandType = uint32(ua.DeadbandTypePercent)
+		f.DeadbandValue = m.DeadbandValue
+	default:
+		return nil, fmt.Errorf("unknown deadband type %s", m.DeadbandType)
+	}
+
+	p.Filter = ua.NewExtensionObject(f)
+
+	return p, nil
+}
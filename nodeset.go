@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gualogger/logging"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/monitor"
+	"github.com/gopcua/opcua/ua"
+)
+
+var nodeset *NodeSet
+
+// Subscribed nodes added or removed at runtime on top of the configured subscription
+// Changes are applied to the live data change subscriptions without touching the other items and are kept across reconnects.
+// Added nodes are monitored by the default subscription with the subscription wide monitoring settings, per node settings require a restart
+type NodeSet struct {
+	sync.Mutex
+	cfg     *Subscription
+	added   []string
+	removed map[string]bool
+	paths   map[string]BrowsePath
+	items   map[string]trackedItem
+	subs    map[string]*monitor.Subscription
+	client  *opcua.Client
+}
+
+// Monitored item of a node and the subscription it belongs to
+type trackedItem struct {
+	sub  *monitor.Subscription
+	item monitor.Item
+}
+
+// Initializes a new node set for the configured subscription s
+func NewNodeSet(s *Subscription) *NodeSet {
+	return &NodeSet{
+		cfg:     s,
+		removed: make(map[string]bool),
+		paths:   s.BrowsePaths(),
+		items:   make(map[string]trackedItem),
+		subs:    make(map[string]*monitor.Subscription),
+	}
+}
+
+// Returns the subscribed node ids including runtime changes
+func (n *NodeSet) NodeIDs() []string {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.apply(n.cfg.NodeIDs())
+}
+
+// Returns the node ids of every data change subscription keyed by group name including runtime changes
+// Added nodes belong to the default subscription with the empty name
+func (n *NodeSet) SubscriptionNodeIDs() map[string][]string {
+	n.Lock()
+	defer n.Unlock()
+
+	ids := n.cfg.SubscriptionNodeIDs()
+	seen := make(map[string]bool)
+
+	for g := range ids {
+		list := make([]string, 0, len(ids[g]))
+
+		for _, id := range ids[g] {
+			if !n.removed[nodeKey(id)] {
+				seen[nodeKey(id)] = true
+				list = append(list, id)
+			}
+		}
+
+		ids[g] = list
+	}
+
+	for _, id := range n.added {
+		if !seen[nodeKey(id)] {
+			seen[nodeKey(id)] = true
+			ids[""] = append(ids[""], id)
+		}
+	}
+
+	return ids
+}
+
+// Returns the node ids of all configured nodes including polled groups and runtime changes
+func (n *NodeSet) AllNodeIDs() []string {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.apply(n.cfg.AllNodeIDs())
+}
+
+// Returns all configured and added browse paths keyed by their id
+func (n *NodeSet) BrowsePaths() map[string]BrowsePath {
+	n.Lock()
+	defer n.Unlock()
+
+	paths := make(map[string]BrowsePath, len(n.paths))
+	for id, p := range n.paths {
+		paths[id] = p
+	}
+	return paths
+}
+
+func (n *NodeSet) apply(ids []string) []string {
+	res := make([]string, 0, len(ids)+len(n.added))
+	seen := make(map[string]bool)
+
+	for _, id := range append(ids, n.added...) {
+		k := nodeKey(id)
+		if n.removed[k] || seen[k] {
+			continue
+		}
+		seen[k] = true
+		res = append(res, id)
+	}
+
+	return res
+}
+
+func (n *NodeSet) monitored() map[string]bool {
+	set := make(map[string]bool)
+	for _, id := range n.apply(n.cfg.NodeIDs()) {
+		set[nodeKey(id)] = true
+	}
+	return set
+}
+
+// Attaches the data change subscription of a group of the current session and its items keyed by node key
+func (n *NodeSet) Attach(c *opcua.Client, group string, sub *monitor.Subscription, items map[string]monitor.Item) {
+	n.Lock()
+	defer n.Unlock()
+
+	n.client = c
+	n.subs[group] = sub
+
+	for k, it := range items {
+		n.items[k] = trackedItem{sub: sub, item: it}
+	}
+}
+
+// Detaches the subscription of a group, changes made until the next Attach are applied on the next connect
+func (n *NodeSet) Detach(group string, sub *monitor.Subscription) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.subs[group] != sub {
+		return
+	}
+
+	delete(n.subs, group)
+
+	for k, it := range n.items {
+		if it.sub == sub {
+			delete(n.items, k)
+		}
+	}
+
+	if len(n.subs) == 0 {
+		n.client = nil
+	}
+}
+
+// Adds nodes to the subscription, ids listed in paths are browse paths, all others node ids
+// Without active subscription the nodes are added on the next connect, nodes failing on the live subscription are not kept
+func (n *NodeSet) Add(ctx context.Context, ids []string, paths map[string]BrowsePath) map[string]error {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.add(ctx, ids, paths)
+}
+
+func (n *NodeSet) add(ctx context.Context, ids []string, paths map[string]BrowsePath) map[string]error {
+
+	registerPaths(paths)
+
+	errs := make(map[string]error)
+	cur := n.monitored()
+	add := make([]string, 0, len(ids))
+
+	for _, id := range ids {
+		switch {
+		case id == "":
+			errs[id] = fmt.Errorf("empty node id")
+		case cur[nodeKey(id)]:
+			errs[id] = fmt.Errorf("node is already monitored")
+		default:
+			cur[nodeKey(id)] = true
+			add = append(add, id)
+		}
+	}
+
+	sub := n.subs[""]
+
+	if sub == nil {
+		for _, id := range add {
+			n.include(id, paths)
+		}
+		return errs
+	}
+
+	for id, err := range resolver.Add(ctx, n.client, add, paths) {
+		errs[id] = err
+	}
+
+	ok := make([]string, 0, len(add))
+	for _, id := range add {
+		if errs[id] == nil {
+			ok = append(ok, id)
+		}
+	}
+
+	metadata.Add(ctx, n.client, ok)
+	structs.Add(ctx, n.client, ok)
+
+	for _, id := range ok {
+		mp, err := n.cfg.Monitoring.Parameters()
+
+		if err != nil {
+			errs[id] = err
+			continue
+		}
+
+		nid, _ := resolver.NodeID(id)
+
+		items, err := sub.AddMonitorItems(ctx, monitor.Request{NodeID: nid, MonitoringMode: ua.MonitoringModeReporting, MonitoringParameters: mp})
+
+		if err != nil {
+			errs[id] = err
+			continue
+		}
+
+		n.items[nodeKey(id)] = trackedItem{sub: sub, item: items[0]}
+		n.include(id, paths)
+
+		logging.Logger.Info(fmt.Sprintf("added node %s to subscription %d", id, sub.SubscriptionID()), "func", "AddNodes")
+	}
+
+	return errs
+}
+
+// Removes nodes from the subscription, the monitored items of the live subscription are deleted on the server
+func (n *NodeSet) Remove(ctx context.Context, ids []string) map[string]error {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.remove(ctx, ids)
+}
+
+func (n *NodeSet) remove(ctx context.Context, ids []string) map[string]error {
+
+	errs := make(map[string]error)
+	cur := n.monitored()
+
+	for _, id := range ids {
+		k := nodeKey(id)
+
+		if !cur[k] {
+			errs[id] = fmt.Errorf("node is not monitored")
+			continue
+		}
+
+		if it, ok := n.items[k]; ok {
+			if err := it.sub.RemoveMonitorItems(ctx, it.item); err != nil {
+				errs[id] = err
+				continue
+			}
+			delete(n.items, k)
+
+			logging.Logger.Info(fmt.Sprintf("removed node %s from subscription %d", id, it.sub.SubscriptionID()), "func", "RemoveNodes")
+		}
+
+		n.exclude(id)
+		delete(cur, k)
+	}
+
+	return errs
+}
+
+// Applies the subscribed nodes of a reloaded configuration as runtime changes to the configuration loaded at startup
+func (n *NodeSet) Reload(ctx context.Context, s *Subscription) map[string]error {
+	n.Lock()
+	defer n.Unlock()
+
+	want := make(map[string]bool)
+	add := make([]string, 0)
+	rem := make([]string, 0)
+	cur := n.monitored()
+
+	for _, id := range s.NodeIDs() {
+		want[nodeKey(id)] = true
+		if !cur[nodeKey(id)] {
+			add = append(add, id)
+		}
+	}
+
+	for _, id := range n.apply(n.cfg.NodeIDs()) {
+		if !want[nodeKey(id)] {
+			rem = append(rem, id)
+		}
+	}
+
+	errs := n.remove(ctx, rem)
+
+	for id, err := range n.add(ctx, add, s.BrowsePaths()) {
+		errs[id] = err
+	}
+
+	logging.Logger.Info(fmt.Sprintf("reloaded nodes - added: %d - removed: %d - failed: %d", len(add), len(rem), len(errs)), "func", "ReloadNodes")
+
+	return errs
+}
+
+func (n *NodeSet) include(id string, paths map[string]BrowsePath) {
+	k := nodeKey(id)
+	delete(n.removed, k)
+
+	if p, ok := paths[id]; ok {
+		n.paths[id] = p
+	}
+
+	for _, c := range n.cfg.NodeIDs() {
+		if nodeKey(c) == k {
+			return
+		}
+	}
+
+	n.added = append(n.added, id)
+}
+
+func (n *NodeSet) exclude(id string) {
+	k := nodeKey(id)
+
+	for i, a := range n.added {
+		if nodeKey(a) == k {
+			n.added = append(n.added[:i], n.added[i+1:]...)
+			return
+		}
+	}
+
+	n.removed[k] = true
+}
+
+// Reloads the node lists of the configuration file on SIGHUP until ctx is cancelled
+func RunReloadHook(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			c, err := LoadConfig()
+
+			if err != nil {
+				logging.Logger.Error(fmt.Sprintf("unable to reload configuration: %s", err.Error()), "func", "RunReloadHook")
+				continue
+			}
+
+			for id, err := range nodeset.Reload(ctx, &c.Opcua.Subscription) {
+				logging.Logger.Error(fmt.Sprintf("unable to apply node %s: %s", id, err.Error()), "func", "RunReloadHook")
+			}
+		}
+	}
+}
+
+// Converts the errors of a node operation into messages for api responses
+func errMessages(errs map[string]error) map[string]string {
+	msg := make(map[string]string, len(errs))
+	for id, err := range errs {
+		msg[id] = err.Error()
+	}
+	return msg
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"gualogger/handlers"
 	"gualogger/logging"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gopcua/opcua"
@@ -13,89 +16,31 @@ import (
 )
 
 var (
-	last_keepalive      time.Time
-	con_active          bool
-	retry_count         int
-	current_retry_count = 0
-	Subs                map[uint32]*monitor.Subscription
-	current_client      *opcua.Client
+	con_active     atomic.Bool
+	Subs           map[uint32]*monitor.Subscription
+	subs_mu        sync.Mutex
+	current_client *opcua.Client
 )
 
-func (o *OpcConfig) InitSuperVisor(ctx context.Context) {
-
-	retry_count = o.Connection.Retries
+// Connects to the server and supervises the connection until ctx is cancelled or the maximum number of retries is exceeded
+// The session is recreated if it stays degraded for six times the subscription interval
+func (o *OpcConfig) InitSuperVisor(ctx context.Context) error {
 
 	Subs = make(map[uint32]*monitor.Subscription)
 
-	c, err := o.Connection.CreateClient(ctx)
-
-	if err != nil {
-		logging.Logger.Error(err.Error(), "func", "InitSuperVisor")
-		return
-	}
-
-	logging.Logger.Info(fmt.Sprintf("successfully connected to opcua on endpoint %s:%d", o.Connection.Endpoint, o.Connection.Port))
-
-	subctx, cancel := context.WithCancel(ctx)
-
-	if err := InitSubs(c, ctx, subctx, &o.Subscription.Nodeids, o.Subscription.Interval); err != nil {
-		logging.Logger.Error(fmt.Sprintf("error while creating node monitor: %s", err.Error()), "func", "InitSuperVisor")
-		return
-	}
-
-	con_active = true
-
-	for {
-
-		time.Sleep(3 * time.Duration(o.Subscription.Interval))
-
-		if time.Since(last_keepalive) > time.Duration(6*o.Subscription.Interval)*time.Second {
-
-			current_retry_count++
-
-			if retry_count < current_retry_count {
-
-				logging.Logger.Warn(fmt.Sprintf("maximum number of %d retries exceeded- shutting down", retry_count), "func", "InitSuperVisor")
-				cancel()
-				ctx.Done()
-				break
-			}
-
-			con_active = false
-
-			logging.Logger.Warn(fmt.Sprintf("received last keepalive over %d seconds ago attempting retry attempt %d/%d", 60, current_retry_count, retry_count), "func", "InitSuperVisor")
-
-			if con_active {
-				cancel()
-				c.Close(ctx)
-			}
-
-			c, err = o.Connection.CreateClient(ctx)
-
-			if err != nil {
-				logging.Logger.Error(err.Error(), "func", "InitSuperVisor")
-				continue
-			}
-
-			subctx, cancel = context.WithCancel(ctx)
-
-			if err := InitSubs(c, ctx, subctx, &o.Subscription.Nodeids, o.Subscription.Interval); err != nil {
-				logging.Logger.Error(fmt.Sprintf("error while creating node monitor: %s", err.Error()), "func", "InitSuperVisor")
-				continue
-			}
-			logging.Logger.Info("connection retry successful")
-			con_active = true
-			current_retry_count = 0
-		}
-
-	}
+	sv := NewSupervisor(&opcSession{cfg: o}, o.Connection.Retries, 6*o.Subscription.Parameters("").Interval)
 
+	return sv.Run(ctx)
 }
 
 func (c *OpcConnection) CreateClient(ctx context.Context) (*opcua.Client, error) {
 
 	con_string := fmt.Sprintf("opc.tcp://%s:%d", c.Endpoint, c.Port)
 
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
 	eps, err := opcua.GetEndpoints(ctx, con_string)
 
 	if err != nil {
@@ -108,10 +53,15 @@ func (c *OpcConnection) CreateClient(ctx context.Context) (*opcua.Client, error)
 
 	ep := opcua.SelectEndpoint(eps, c.Policy, ua.MessageSecurityModeFromString(c.Mode))
 
+	if ep == nil {
+		return nil, fmt.Errorf("no endpoint found for policy %s and mode %s - check configuration", c.Policy, c.Mode)
+	}
+
 	opts := []opcua.Option{
-		opcua.ApplicationName("guanaco"),
-		opcua.AutoReconnect(true),
-		opcua.ReconnectInterval(10 * time.Second),
+		opcua.ApplicationName(c.AppName()),
+		opcua.ApplicationURI(c.AppURI()),
+		// reconnects are handled by the supervisor
+		opcua.AutoReconnect(false),
 		opcua.SecurityPolicy(c.Policy),
 		opcua.SecurityMode(ua.MessageSecurityModeFromString(c.Mode)),
 	}
@@ -122,7 +72,20 @@ func (c *OpcConnection) CreateClient(ctx context.Context) (*opcua.Client, error)
 		opts = append(opts, opcua.AuthUsername(c.Authentication.Credentials.Username, c.Authentication.Credentials.Password))
 		opts = append(opts, opcua.SecurityFromEndpoint(ep, ua.UserTokenTypeUserName))
 
-	case "Certificate": // Cert Config goes here, but has to be evaluated first
+	case "Certificate":
+		if !hasTokenType(ep, ua.UserTokenTypeCertificate) {
+			return nil, fmt.Errorf("endpoint %s does not accept certificate user tokens", ep.EndpointURL)
+		}
+
+		cert, key, err := LoadKeyPair(c.Authentication.Certificate.CertificatePath, c.Authentication.Certificate.PrivateKeyPath)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid user certificate: %s", err.Error())
+		}
+
+		opts = append(opts, opcua.AuthCertificate(cert))
+		opts = append(opts, opcua.AuthPrivateKey(key))
+		opts = append(opts, opcua.SecurityFromEndpoint(ep, ua.UserTokenTypeCertificate))
 
 	default:
 		opts = append(opts, opcua.AuthAnonymous())
@@ -130,14 +93,37 @@ func (c *OpcConnection) CreateClient(ctx context.Context) (*opcua.Client, error)
 	}
 
 	if c.Policy != "None" {
+		pki := NewPKI(c.Certificate.PKIRoot)
+
+		if err := pki.Setup(); err != nil {
+			return nil, fmt.Errorf("unable to set up pki: %s", err.Error())
+		}
+
+		if err := pki.ValidateServerCert(ep.ServerCertificate, c.Certificate.TrustOnFirstUse); err != nil {
+			return nil, err
+		}
+
+		cp, kp := c.Certificate.KeyPairPaths()
+
+		keypair_mu.Lock()
+
 		if c.Certificate.AutoCreate {
-			if err := CreateKeyPair(); err != nil {
+			if err := c.CreateKeyPair(cp, kp); err != nil {
+				keypair_mu.Unlock()
 				return nil, err
 			}
 		}
 
-		opts = append(opts, opcua.CertificateFile("./certs/cert.pem"))
-		opts = append(opts, opcua.PrivateKeyFile("./certs/key.pem"))
+		cert, key, err := LoadKeyPair(cp, kp)
+
+		keypair_mu.Unlock()
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid application certificate: %s", err.Error())
+		}
+
+		opts = append(opts, opcua.Certificate(cert))
+		opts = append(opts, opcua.PrivateKey(key))
 	}
 
 	client, err := opcua.NewClient(con_string, opts...)
@@ -155,7 +141,19 @@ func (c *OpcConnection) CreateClient(ctx context.Context) (*opcua.Client, error)
 
 }
 
-func InitSubs(c *opcua.Client, pctx context.Context, ctx context.Context, ids *[]string, iv int) error {
+// Returns true if the endpoint offers a user token policy of the given type
+func hasTokenType(ep *ua.EndpointDescription, t ua.UserTokenType) bool {
+	for _, p := range ep.UserIdentityTokens {
+		if p.TokenType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Creates the node monitor and one data change subscription per subscribe group for the current node set
+// Asynchronous subscription errors such as status change notifications are reported to eh, wg is done once all subscriptions are terminated
+func InitSubs(c *opcua.Client, pctx context.Context, ctx context.Context, s *Subscription, eh monitor.ErrHandler, wg *sync.WaitGroup) error {
 	m, err := monitor.NewNodeMonitor(c)
 
 	if err != nil {
@@ -163,144 +161,341 @@ func InitSubs(c *opcua.Client, pctx context.Context, ctx context.Context, ids *[
 		return err
 	}
 
-	go CreateSubscription(pctx, ctx, m, ids, iv)
+	m.SetErrorHandler(eh)
+
+	for g, ids := range nodeset.SubscriptionNodeIDs() {
+		wg.Add(1)
+		go CreateSubscription(pctx, ctx, m, s, g, ids, wg)
+	}
+
+	// give the subscriptions time to be created before the first health check, unless the session is closed meanwhile
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * time.Second):
+	}
 
-	time.Sleep(10 * time.Second)
 	return nil
 }
 
-func CreateSubscription(pctx context.Context, ctx context.Context, m *monitor.NodeMonitor, ids *[]string, iv int) {
+// Time granted to delete a subscription on the server after its context was cancelled
+const terminateTimeout = 5 * time.Second
 
-	sub, err := m.Subscribe(pctx, &opcua.SubscriptionParameters{Interval: time.Duration(iv) * time.Second},
+// Creates the data change subscription of a group and monitors ids until ctx is cancelled, the default subscription has the empty group name
+func CreateSubscription(pctx context.Context, ctx context.Context, m *monitor.NodeMonitor, s *Subscription, group string, ids []string, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	params := s.Parameters(group)
+
+	sub, err := m.Subscribe(pctx, params,
 		func(s *monitor.Subscription, dcm *monitor.DataChangeMessage) {
 			if dcm.Error != nil {
 				logging.Logger.Error(fmt.Sprintf("error with received sub message: %s - nodeid %s", dcm.Error.Error(), dcm.NodeID))
-			} else if dcm.Status != ua.StatusOK {
-				logging.Logger.Error(fmt.Sprintf("received bad status for sub message: %s - nodeid %s", dcm.Status, dcm.NodeID))
 			} else {
+				if dcm.Status != ua.StatusOK {
+					logging.Logger.Debug(fmt.Sprintf("received status %s for sub message - nodeid %s", dcm.Status, dcm.NodeID))
+				}
 
-				dt := DeferDatatype(dcm.DataValue.Value.Value())
-
-				if dcm.NodeID.String() == "i=2258" {
-					last_keepalive = time.Now()
-				} else {
-					p := handlers.Payload{Value: dcm.Value.Value(), TS: dcm.SourceTimestamp, Name: dcm.NodeID.StringID(), Id: dcm.NodeID.String(), Datatype: dt}
+				recv := time.Now()
+				key := resolver.Key(dcm.NodeID)
 
-					mgr.Publish(ctx, p)
+				timestamps.CheckSkew(key, dcm.DataValue, recv)
 
-				}
+				PublishValue(ctx, NewPayload(key, dcm.NodeID, dcm.DataValue, recv))
 
 			}
 
 		})
 
 	if err != nil {
-		logging.Logger.Error(fmt.Sprintf("error while creating subscription: %s", err.Error()))
+		logging.Logger.Error(fmt.Sprintf("error while creating subscription %s: %s", groupName(group), err.Error()))
 		return
 	}
 
-	for _, n := range *ids {
-		_, err := sub.AddMonitorItems(ctx, monitor.Request{NodeID: ua.MustParseNodeID(n), MonitoringMode: ua.MonitoringModeReporting, MonitoringParameters: &ua.MonitoringParameters{DiscardOldest: true, QueueSize: 1}})
+	items := make(map[string]monitor.Item)
+
+	for _, n := range ids {
+		mp, err := s.MonitoringFor(n).Parameters()
 		if err != nil {
-			logging.Logger.Error(fmt.Sprintf("error adding subscription item: %s", err.Error()))
+			logging.Logger.Error(fmt.Sprintf("invalid monitoring settings for node %s: %s", n, err.Error()))
 			continue
 		}
-	}
 
-	_, err = sub.AddMonitorItems(ctx, monitor.Request{NodeID: ua.MustParseNodeID("i=2258"), MonitoringMode: ua.MonitoringModeReporting, MonitoringParameters: &ua.MonitoringParameters{DiscardOldest: true, QueueSize: 1}})
+		nid, ok := resolver.NodeID(n)
+		if !ok {
+			continue
+		}
 
-	if err != nil {
-		logging.Logger.Error(fmt.Sprintf("error adding subscription item: %s", err.Error()))
-		return
+		res, err := sub.AddMonitorItems(ctx, monitor.Request{NodeID: nid, MonitoringMode: ua.MonitoringModeReporting, MonitoringParameters: mp})
+		if err != nil {
+			logging.Logger.Error(fmt.Sprintf("error adding subscription item: %s", err.Error()))
+			continue
+		}
+
+		items[nodeKey(n)] = res[0]
 	}
 
 	id := sub.SubscriptionID()
+
+	subs_mu.Lock()
 	Subs[id] = sub
+	subs_mu.Unlock()
+
+	// nodes added or removed at runtime are applied to this subscription until it is terminated
+	nodeset.Attach(current_client, group, sub, items)
 
-	logging.Logger.Info(fmt.Sprintf("successfully initialized subscription with id:%d", id))
+	logging.Logger.Info(fmt.Sprintf("successfully initialized subscription %s with id:%d - interval: %s - items: %d", groupName(group), id, params.Interval, len(items)))
 
-	defer TerminateSub(pctx, sub, id)
 	<-ctx.Done()
+
+	nodeset.Detach(group, sub)
+
+	// pctx is already cancelled on shutdown, the subscription is deleted with its own deadline
+	tctx, cancel := context.WithTimeout(context.Background(), terminateTimeout)
+	defer cancel()
+
+	TerminateSub(tctx, sub, id)
 }
 
 func TerminateSub(ctx context.Context, s *monitor.Subscription, id uint32) {
 
 	logging.Logger.Warn(fmt.Sprintf("terminating subscription with id: %d - delivered: %d - dropped: %d", id, s.Delivered(), s.Dropped()))
+	subs_mu.Lock()
 	delete(Subs, id)
+	subs_mu.Unlock()
+
 	s.Unsubscribe(ctx)
 
 }
 
-func DeferDatatype(i interface{}) string {
-	var dt string
-	switch i.(type) {
-	case int:
-		dt = "Int"
-	case uint8:
-		dt = "u8"
-	case uint16:
-		dt = "u16"
-	case uint32:
-		dt = "u32"
-	case int8:
-		dt = "i8"
-	case int16:
-		dt = "i16"
-	case int32:
-		dt = "i32"
-	case int64:
-		dt = "i64"
-	case float32:
-		dt = "f32"
-	case float64:
-		dt = "f64"
-	case bool:
-		dt = "Bool"
-	default:
+// Returns the name of a subscription group for log messages
+func groupName(group string) string {
+	if group == "" {
+		return "default"
+	}
+	return group
+}
+
+// Short names of the OPC UA built-in types, the names of the numeric types are kept for existing consumers
+var datatypeNames = map[ua.TypeID]string{
+	ua.TypeIDNull:            "Null",
+	ua.TypeIDBoolean:         "Bool",
+	ua.TypeIDSByte:           "i8",
+	ua.TypeIDByte:            "u8",
+	ua.TypeIDInt16:           "i16",
+	ua.TypeIDUint16:          "u16",
+	ua.TypeIDInt32:           "i32",
+	ua.TypeIDUint32:          "u32",
+	ua.TypeIDInt64:           "i64",
+	ua.TypeIDUint64:          "u64",
+	ua.TypeIDFloat:           "f32",
+	ua.TypeIDDouble:          "f64",
+	ua.TypeIDString:          "Str",
+	ua.TypeIDDateTime:        "DateTime",
+	ua.TypeIDGUID:            "Guid",
+	ua.TypeIDByteString:      "ByteString",
+	ua.TypeIDXMLElement:      "XmlElement",
+	ua.TypeIDNodeID:          "NodeId",
+	ua.TypeIDExpandedNodeID:  "ExpandedNodeId",
+	ua.TypeIDStatusCode:      "StatusCode",
+	ua.TypeIDQualifiedName:   "QualifiedName",
+	ua.TypeIDLocalizedText:   "LocalizedText",
+	ua.TypeIDExtensionObject: "ExtensionObject",
+	ua.TypeIDDataValue:       "DataValue",
+	ua.TypeIDVariant:         "Variant",
+	ua.TypeIDDiagnosticInfo:  "DiagnosticInfo",
+}
+
+// Returns the datatype name of a value, arrays get one [] suffix per dimension, e.g. f64[][] for a matrix
+func DeferDatatype(v *ua.Variant) string {
+	if v == nil {
+		return datatypeNames[ua.TypeIDNull]
+	}
+
+	dt, ok := datatypeNames[v.Type()]
+
+	if !ok {
 		dt = "Str"
+	}
 
+	if v.Has(ua.VariantArrayValues) {
+		for range ValueDimensions(v) {
+			dt += "[]"
+		}
 	}
 
 	return dt
 }
 
+// Returns the dimensions of an array value, nil for scalars
+func ValueDimensions(v *ua.Variant) []int32 {
+	if v == nil || !v.Has(ua.VariantArrayValues) {
+		return nil
+	}
+
+	if d := v.ArrayDimensions(); len(d) > 0 {
+		return d
+	}
+
+	return []int32{v.ArrayLength()}
+}
+
+// Converts a decoded value into a JSON friendly representation
+// Identifiers and texts become strings, arrays and matrices become (nested) []interface{}
+func ExportValue(v interface{}) interface{} {
+	return exportValue(v, structs.Decode)
+}
+
+// Converts v like ExportValue, extension objects are decoded by decode
+func exportValue(v interface{}, decode func(*ua.ExtensionObject) interface{}) interface{} {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case *ua.GUID:
+		return x.String()
+	case *ua.NodeID:
+		return x.String()
+	case *ua.ExpandedNodeID:
+		return x.String()
+	case ua.StatusCode:
+		return uint32(x)
+	case *ua.QualifiedName:
+		return fmt.Sprintf("%d:%s", x.NamespaceIndex, x.Name)
+	case *ua.LocalizedText:
+		return x.Text
+	case ua.XMLElement:
+		return string(x)
+	case *ua.XMLElement:
+		return string(*x)
+	case *ua.DataValue:
+		if x.Value == nil {
+			return nil
+		}
+		return exportValue(x.Value.Value(), decode)
+	case *ua.Variant:
+		if x == nil {
+			return nil
+		}
+		return exportValue(x.Value(), decode)
+	case *ua.ExtensionObject:
+		return decode(x)
+	case []byte:
+		return x
+	}
+
+	rv := reflect.ValueOf(v)
+
+	if rv.Kind() != reflect.Slice {
+		return v
+	}
+
+	arr := make([]interface{}, rv.Len())
+
+	for i := range arr {
+		arr[i] = exportValue(rv.Index(i).Interface(), decode)
+	}
+
+	return arr
+}
+
+// Creates the payload of a data value, id is the configured id the node is identified by
+// The timestamp is selected by the configured timestamp source, recv is the time the value was received or zero for historic values
+func NewPayload(id string, nid *ua.NodeID, dv *ua.DataValue, recv time.Time) handlers.Payload {
+	return handlers.Payload{
+		Value:      ExportValue(dv.Value),
+		Dimensions: ValueDimensions(dv.Value),
+		TS:         timestamps.Select(id, dv, recv),
+		ServerTS:   dv.ServerTimestamp,
+		SourceTS:   dv.SourceTimestamp,
+		Status:     uint32(dv.Status),
+		Quality:    Quality(dv.Status),
+		Name:       nid.StringID(),
+		Id:         id,
+		Datatype:   DeferDatatype(dv.Value),
+	}
+}
+
+// Returns the quality category of a status code, given by its two most significant bits
+func Quality(code ua.StatusCode) string {
+	switch uint32(code) >> 30 {
+	case 0:
+		return handlers.QualityGood
+	case 1:
+		return handlers.QualityUncertain
+	default:
+		return handlers.QualityBad
+	}
+}
+
+// Reads the current values of all configured nodes
 func Read(ctx context.Context) []handlers.Payload {
+	return ReadNodes(ctx, nodeset.AllNodeIDs())
+}
+
+// Reads the current values of the given nodes in a single batched read request
+// Values with a bad or uncertain status are exported with their status code
+func ReadNodes(ctx context.Context, ids []string) []handlers.Payload {
 
 	pay := make([]handlers.Payload, 0)
 	nodes := make([]*ua.ReadValueID, 0)
+	keys := make([]string, 0)
 
-	if !con_active {
+	if !con_active.Load() {
 		return pay
 	}
 
-	for _, n := range conf.Opcua.Subscription.Nodeids {
+	for _, n := range ids {
 
-		id, err := ua.ParseNodeID(n)
+		id, ok := resolver.NodeID(n)
 
-		if err != nil {
-			logging.Logger.Error(fmt.Sprintf("error parsing node id while reading:%s", err.Error()), "func", "read")
+		if !ok {
 			continue
 		}
 
 		nodes = append(nodes, &ua.ReadValueID{NodeID: id})
+		keys = append(keys, nodeKey(n))
 	}
 
-	res, err := current_client.Read(ctx, &ua.ReadRequest{NodesToRead: nodes})
+	if len(nodes) == 0 {
+		return pay
+	}
+
+	res, err := current_client.Read(ctx, &ua.ReadRequest{NodesToRead: nodes, TimestampsToReturn: ua.TimestampsToReturnBoth})
 
 	if err != nil {
 		logging.Logger.Error(fmt.Sprintf("error occured during opc ua read request:%s", err.Error()), "func", "read")
 		return pay
 	}
 
-	for _, r := range res.Results {
-		dt := DeferDatatype(r.Value.Value())
+	recv := time.Now()
 
-		p := handlers.Payload{Value: r.Value.Value(), TS: r.SourceTimestamp, Name: "", Id: "", Datatype: dt}
+	for i, r := range res.Results {
+		if i >= len(nodes) {
+			break
+		}
 
-		pay = append(pay, p)
+		id := nodes[i].NodeID
+
+		if r.Status != ua.StatusOK {
+			logging.Logger.Debug(fmt.Sprintf("received status %s for read - nodeid %s", r.Status, id), "func", "read")
+		}
+
+		pay = append(pay, NewPayload(keys[i], id, r, recv))
 
 	}
 
 	return pay
 
 }
+
+// Records and publishes a received value, if it passes the change filter
+// Only good samples advance the backfill window, bad samples may be stamped while the source was unavailable
+func PublishValue(ctx context.Context, p handlers.Payload) {
+	if p.Quality == handlers.QualityGood {
+		MarkSeen(p.Id, p.SourceTS)
+	}
+
+	if filter.Pass(p) {
+		mgr.Publish(ctx, p)
+	}
+}
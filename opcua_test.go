@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua"
+)
+
+// Certificate user token tests against a local test server, configured by environment variables
+//
+//	GUALOGGER_TEST_ENDPOINT   host of the server, the tests are skipped if unset
+//	GUALOGGER_TEST_PORT       port of the server, defaults to 4840
+//	GUALOGGER_TEST_POLICY     security policy, defaults to Basic256Sha256
+//	GUALOGGER_TEST_MODE       security mode, defaults to SignAndEncrypt
+//	GUALOGGER_TEST_USER_CERT  user certificate trusted by the server
+//	GUALOGGER_TEST_USER_KEY   private key of the user certificate
+//
+// The server has to accept the application certificate created for the test and require certificate user tokens
+func testConnection(t *testing.T) *OpcConnection {
+	t.Helper()
+
+	host := os.Getenv("GUALOGGER_TEST_ENDPOINT")
+
+	if host == "" {
+		t.Skip("GUALOGGER_TEST_ENDPOINT not set - skipping integration test")
+	}
+
+	cert, key := os.Getenv("GUALOGGER_TEST_USER_CERT"), os.Getenv("GUALOGGER_TEST_USER_KEY")
+
+	if cert == "" || key == "" {
+		t.Skip("GUALOGGER_TEST_USER_CERT and GUALOGGER_TEST_USER_KEY not set - skipping integration test")
+	}
+
+	port := 4840
+
+	if p := os.Getenv("GUALOGGER_TEST_PORT"); p != "" {
+		var err error
+		if port, err = strconv.Atoi(p); err != nil {
+			t.Fatalf("invalid GUALOGGER_TEST_PORT %s: %s", p, err.Error())
+		}
+	}
+
+	c := &OpcConnection{
+		Endpoint: host,
+		Port:     port,
+		Policy:   envOr("GUALOGGER_TEST_POLICY", "Basic256Sha256"),
+		Mode:     envOr("GUALOGGER_TEST_MODE", "SignAndEncrypt"),
+	}
+
+	c.Authentication.Type = "Certificate"
+	c.Authentication.Certificate.CertificatePath = cert
+	c.Authentication.Certificate.PrivateKeyPath = key
+
+	c.Certificate.AutoCreate = true
+	c.Certificate.TrustOnFirstUse = true
+	c.Certificate.PKIRoot = filepath.Join(t.TempDir(), "pki")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := opcua.GetEndpoints(ctx, "opc.tcp://"+host+":"+strconv.Itoa(port)); err != nil {
+		t.Skipf("test server %s:%d not available - skipping integration test: %s", host, port, err.Error())
+	}
+
+	return c
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func connect(c *OpcConnection) (*opcua.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return c.CreateClient(ctx)
+}
+
+func TestCertificateAuthentication(t *testing.T) {
+	c := testConnection(t)
+
+	cl, err := connect(c)
+
+	if err != nil {
+		t.Fatalf("connecting with user certificate %s failed: %s", c.Authentication.Certificate.CertificatePath, err.Error())
+	}
+
+	defer cl.Close(context.Background())
+
+	if cl.Session() == nil {
+		t.Fatal("no session activated with the user certificate")
+	}
+}
+
+func TestCertificateAuthenticationUntrusted(t *testing.T) {
+	c := testConnection(t)
+
+	// a freshly created self-signed certificate is unknown to the server
+	dir := t.TempDir()
+	cp, kp := filepath.Join(dir, "user.pem"), filepath.Join(dir, "user.key")
+
+	if err := c.CreateKeyPair(cp, kp); err != nil {
+		t.Fatalf("unable to create user certificate: %s", err.Error())
+	}
+
+	c.Authentication.Certificate.CertificatePath = cp
+	c.Authentication.Certificate.PrivateKeyPath = kp
+
+	cl, err := connect(c)
+
+	if err == nil {
+		cl.Close(context.Background())
+		t.Fatal("server accepted an untrusted user certificate")
+	}
+}
+
+func TestCertificateAuthenticationWrongKey(t *testing.T) {
+	c := testConnection(t)
+
+	dir := t.TempDir()
+	cp, kp := filepath.Join(dir, "other.pem"), filepath.Join(dir, "other.key")
+
+	if err := c.CreateKeyPair(cp, kp); err != nil {
+		t.Fatalf("unable to create key: %s", err.Error())
+	}
+
+	// trusted certificate with the key of another certificate
+	c.Authentication.Certificate.PrivateKeyPath = kp
+
+	cl, err := connect(c)
+
+	if err == nil {
+		cl.Close(context.Background())
+		t.Fatal("connected with a private key not matching the user certificate")
+	}
+
+	if !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected a key mismatch error, got: %s", err.Error())
+	}
+}
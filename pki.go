@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"gualogger/logging"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Standard OPC UA PKI directory layout below a configurable root
+//
+//	own/certs, own/private         application certificate and private key
+//	trusted/certs, trusted/crl     trusted server certificates and their revocation lists
+//	issuers/certs, issuers/crl     CA certificates used to validate chains, not trusted on their own
+//	rejected/certs                 unknown server certificates waiting for an operator decision
+type PKI struct {
+	Root string
+}
+
+const defaultPKIRoot = "./pki"
+
+// Initializes a PKI rooted at the given directory, an empty root falls back to ./pki
+func NewPKI(root string) *PKI {
+	if root == "" {
+		root = defaultPKIRoot
+	}
+	return &PKI{Root: root}
+}
+
+func (p *PKI) OwnCert() string {
+	return filepath.Join(p.Root, "own", "certs", "cert.pem")
+}
+
+func (p *PKI) OwnKey() string {
+	return filepath.Join(p.Root, "own", "private", "key.pem")
+}
+
+func (p *PKI) TrustedCerts() string {
+	return filepath.Join(p.Root, "trusted", "certs")
+}
+
+func (p *PKI) TrustedCRL() string {
+	return filepath.Join(p.Root, "trusted", "crl")
+}
+
+func (p *PKI) IssuerCerts() string {
+	return filepath.Join(p.Root, "issuers", "certs")
+}
+
+func (p *PKI) IssuerCRL() string {
+	return filepath.Join(p.Root, "issuers", "crl")
+}
+
+func (p *PKI) RejectedCerts() string {
+	return filepath.Join(p.Root, "rejected", "certs")
+}
+
+// Creates all directories of the layout, the private key directory is only accessible by the owner
+// A key pair of earlier versions in ./certs is copied to own/ on first start
+func (p *PKI) Setup() error {
+	dirs := []string{filepath.Dir(p.OwnCert()), p.TrustedCerts(), p.TrustedCRL(), p.IssuerCerts(), p.IssuerCRL(), p.RejectedCerts()}
+
+	for _, d := range dirs {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p.OwnKey()), 0700); err != nil {
+		return err
+	}
+
+	return p.migrateLegacy()
+}
+
+// Location of the application key pair of versions before the PKI layout
+const (
+	legacyCertPath = "./certs/cert.pem"
+	legacyKeyPath  = "./certs/key.pem"
+)
+
+// Copies the key pair of earlier versions from ./certs to own/ if own/ holds no key pair yet
+// Servers keep trusting the client as its certificate does not change, ./certs is left untouched
+func (p *PKI) migrateLegacy() error {
+	if _, err := os.Stat(p.OwnCert()); err == nil {
+		return nil
+	}
+
+	if _, err := os.Stat(p.OwnKey()); err == nil {
+		return nil
+	}
+
+	cb, err := os.ReadFile(legacyCertPath)
+
+	if err != nil {
+		return nil
+	}
+
+	kb, err := os.ReadFile(legacyKeyPath)
+
+	if err != nil {
+		return nil
+	}
+
+	if err := os.WriteFile(p.OwnKey(), kb, 0600); err != nil {
+		return fmt.Errorf("unable to migrate %s: %w", legacyKeyPath, err)
+	}
+
+	if err := os.WriteFile(p.OwnCert(), cb, 0644); err != nil {
+		os.Remove(p.OwnKey())
+		return fmt.Errorf("unable to migrate %s: %w", legacyCertPath, err)
+	}
+
+	logging.Logger.Info(fmt.Sprintf("copied application certificate and key of %s to %s", filepath.Dir(legacyCertPath), filepath.Join(p.Root, "own")), "func", "PKI")
+
+	return nil
+}
+
+// Validates a DER encoded server certificate against the trusted and issuers stores
+// Servers may send their chain as concatenated DER certificates, the first is the server certificate and the rest are used as intermediates.
+// A certificate is accepted if it is trusted itself or chains up to a trusted CA, is within its validity period and not revoked.
+// Unknown certificates are copied to rejected/ so an operator can move them to trusted/.
+// With trust on first use an unknown certificate is trusted automatically as long as the trusted store is empty.
+func (p *PKI) ValidateServerCert(der []byte, tofu bool) error {
+
+	certs, err := x509.ParseCertificates(der)
+
+	if err != nil {
+		return fmt.Errorf("unable to parse server certificate: %s", err.Error())
+	}
+
+	if len(certs) == 0 {
+		return fmt.Errorf("server sent no certificate")
+	}
+
+	cert, extra := certs[0], certs[1:]
+
+	now := time.Now()
+
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("server certificate %s is not valid between %s and %s", cert.Subject.CommonName, cert.NotBefore, cert.NotAfter)
+	}
+
+	trusted := loadCerts(p.TrustedCerts())
+	issuers := loadCerts(p.IssuerCerts())
+	crls := loadCRLs(p.TrustedCRL(), p.IssuerCRL())
+
+	chain, ok := buildTrustedChain(cert, trusted, issuers, extra)
+
+	if !ok {
+		if tofu && len(trusted) == 0 {
+			logging.Logger.Warn(fmt.Sprintf("trust on first use - trusting server certificate %s", cert.Subject.CommonName), "func", "ValidateServerCert")
+			return writeCert(p.TrustedCerts(), cert)
+		}
+
+		if err := writeCert(p.RejectedCerts(), cert); err != nil {
+			logging.Logger.Error(fmt.Sprintf("unable to store rejected certificate: %s", err.Error()), "func", "ValidateServerCert")
+		}
+
+		return fmt.Errorf("server certificate %s is not trusted - move it from %s to %s to trust it", cert.Subject.CommonName, p.RejectedCerts(), p.TrustedCerts())
+	}
+
+	// a directly trusted certificate is checked against the crls of its issuer, which is itself if self-signed
+	if len(chain) == 1 {
+		candidates := append([]*x509.Certificate{cert}, extra...)
+		candidates = append(candidates, issuers...)
+		candidates = append(candidates, trusted...)
+
+		if iss := findIssuer(cert, candidates); iss != nil {
+			chain = append(chain, iss)
+		}
+	}
+
+	for i := 0; i < len(chain)-1; i++ {
+		if err := checkRevocation(chain[i], chain[i+1], crls, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the chain from cert up to a self-signed or trusted root, ok is false if no cert of the chain is trusted
+// extra holds intermediates sent along with cert, they are never trusted on their own
+func buildTrustedChain(cert *x509.Certificate, trusted []*x509.Certificate, issuers []*x509.Certificate, extra []*x509.Certificate) ([]*x509.Certificate, bool) {
+
+	roots := x509.NewCertPool()
+	inter := x509.NewCertPool()
+
+	for _, c := range trusted {
+		if c.Equal(cert) {
+			return []*x509.Certificate{cert}, true
+		}
+		roots.AddCert(c)
+	}
+
+	for _, c := range issuers {
+		roots.AddCert(c)
+		inter.AddCert(c)
+	}
+
+	for _, c := range extra {
+		inter.AddCert(c)
+	}
+
+	chains, err := cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: inter, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+
+	if err != nil {
+		return nil, false
+	}
+
+	for _, ch := range chains {
+		for _, c := range ch {
+			for _, t := range trusted {
+				if c.Equal(t) {
+					return ch, true
+				}
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Returns the first certificate that signed cert, nil if none of the candidates did
+func findIssuer(cert *x509.Certificate, candidates []*x509.Certificate) *x509.Certificate {
+	for _, c := range candidates {
+		if cert.CheckSignatureFrom(c) == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// Returns an error if a crl issued by issuer lists the serial number of cert
+// The revocation state is unknown if the issuer only has crls past their NextUpdate
+func checkRevocation(cert *x509.Certificate, issuer *x509.Certificate, crls []*x509.RevocationList, now time.Time) error {
+
+	var stale *x509.RevocationList
+	current := false
+
+	for _, l := range crls {
+		if l.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+
+		for _, e := range l.RevokedCertificateEntries {
+			if e.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return fmt.Errorf("certificate %s has been revoked by %s", cert.Subject.CommonName, issuer.Subject.CommonName)
+			}
+		}
+
+		if !l.NextUpdate.IsZero() && now.After(l.NextUpdate) {
+			stale = l
+			continue
+		}
+
+		current = true
+	}
+
+	if stale != nil && !current {
+		return fmt.Errorf("revocation state of certificate %s is unknown - the crl of %s is outdated since %s", cert.Subject.CommonName, issuer.Subject.CommonName, stale.NextUpdate)
+	}
+
+	return nil
+}
+
+// Loads all pem or der encoded certificates of a directory
+func loadCerts(dir string) []*x509.Certificate {
+
+	certs := make([]*x509.Certificate, 0)
+
+	for _, b := range readDir(dir) {
+		for _, der := range decodeBlocks(b, "CERTIFICATE") {
+			c, err := x509.ParseCertificate(der)
+			if err != nil {
+				logging.Logger.Warn(fmt.Sprintf("skipping invalid certificate in %s: %s", dir, err.Error()), "func", "loadCerts")
+				continue
+			}
+			certs = append(certs, c)
+		}
+	}
+
+	return certs
+}
+
+// Loads all pem or der encoded revocation lists of the given directories
+func loadCRLs(dirs ...string) []*x509.RevocationList {
+
+	crls := make([]*x509.RevocationList, 0)
+
+	for _, dir := range dirs {
+		for _, b := range readDir(dir) {
+			for _, der := range decodeBlocks(b, "X509 CRL") {
+				l, err := x509.ParseRevocationList(der)
+				if err != nil {
+					logging.Logger.Warn(fmt.Sprintf("skipping invalid crl in %s: %s", dir, err.Error()), "func", "loadCRLs")
+					continue
+				}
+				crls = append(crls, l)
+			}
+		}
+	}
+
+	return crls
+}
+
+func readDir(dir string) [][]byte {
+	files := make([][]byte, 0)
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return files
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		files = append(files, b)
+	}
+
+	return files
+}
+
+// Returns the bytes of all pem blocks of type t, or the input itself if it is not pem encoded
+func decodeBlocks(b []byte, t string) [][]byte {
+	blocks := make([][]byte, 0)
+
+	rest := b
+	for {
+		var blk *pem.Block
+		blk, rest = pem.Decode(rest)
+		if blk == nil {
+			break
+		}
+		if blk.Type == t {
+			blocks = append(blocks, blk.Bytes)
+		}
+	}
+
+	if len(blocks) == 0 && len(rest) == len(b) {
+		blocks = append(blocks, b)
+	}
+
+	return blocks
+}
+
+// Writes a certificate der encoded using the `CommonName [thumbprint].der` naming convention
+func writeCert(dir string, cert *x509.Certificate) error {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, cert.Subject.CommonName)
+
+	f := filepath.Join(dir, fmt.Sprintf("%s [%x].der", name, sha1.Sum(cert.Raw)))
+
+	return os.WriteFile(f, cert.Raw, 0644)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var serial int64
+
+// Issues a certificate signed by parent, a nil parent creates a self-signed certificate
+func issue(t *testing.T, cn string, ca bool, parent *testCert) *testCert {
+	t.Helper()
+
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial++
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+	}
+
+	pc, pk := tmpl, k
+
+	if parent != nil {
+		pc, pk = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, pc, k.Public(), pk)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: c, key: k}
+}
+
+// Writes a crl of issuer revoking the given certificates to dir
+func writeCRL(t *testing.T, dir string, issuer *testCert, next time.Time, revoked ...*testCert) {
+	t.Helper()
+
+	serial++
+
+	tmpl := &x509.RevocationList{Number: big.NewInt(serial), ThisUpdate: time.Now().Add(-2 * time.Hour), NextUpdate: next}
+
+	for _, r := range revoked {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{SerialNumber: r.cert.SerialNumber, RevocationTime: time.Now().Add(-time.Hour)})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, issuer.cert, issuer.key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%s-%d.crl", issuer.cert.Subject.CommonName, serial)), der, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestPKI(t *testing.T) *PKI {
+	t.Helper()
+
+	p := NewPKI(filepath.Join(t.TempDir(), "pki"))
+
+	if err := p.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestValidateServerCertChain(t *testing.T) {
+	p := newTestPKI(t)
+
+	root := issue(t, "root", true, nil)
+	inter := issue(t, "inter", true, root)
+	leaf := issue(t, "server", false, inter)
+
+	writeCert(p.TrustedCerts(), root.cert)
+
+	if err := p.ValidateServerCert(leaf.cert.Raw, false); err == nil {
+		t.Fatal("accepted a server certificate without its intermediate")
+	}
+
+	// the intermediate sent along with the server certificate completes the chain
+	chain := append(append([]byte{}, leaf.cert.Raw...), inter.cert.Raw...)
+
+	if err := p.ValidateServerCert(chain, false); err != nil {
+		t.Fatalf("rejected a server certificate with its intermediate: %s", err.Error())
+	}
+
+	writeCRL(t, p.IssuerCRL(), inter, time.Now().Add(time.Hour), leaf)
+
+	if err := p.ValidateServerCert(chain, false); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Fatalf("expected a revocation error, got %v", err)
+	}
+}
+
+func TestValidateServerCertTrustedLeafRevoked(t *testing.T) {
+	p := newTestPKI(t)
+
+	ca := issue(t, "ca", true, nil)
+	leaf := issue(t, "server", false, ca)
+
+	// the server certificate itself is trusted, its issuer is only known as an issuer
+	writeCert(p.TrustedCerts(), leaf.cert)
+	writeCert(p.IssuerCerts(), ca.cert)
+
+	if err := p.ValidateServerCert(leaf.cert.Raw, false); err != nil {
+		t.Fatalf("rejected a trusted server certificate: %s", err.Error())
+	}
+
+	writeCRL(t, p.IssuerCRL(), ca, time.Now().Add(time.Hour), leaf)
+
+	if err := p.ValidateServerCert(leaf.cert.Raw, false); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Fatalf("expected a revocation error, got %v", err)
+	}
+}
+
+func TestValidateServerCertStaleCRL(t *testing.T) {
+	p := newTestPKI(t)
+
+	ca := issue(t, "ca", true, nil)
+	leaf := issue(t, "server", false, ca)
+
+	writeCert(p.TrustedCerts(), ca.cert)
+	writeCRL(t, p.TrustedCRL(), ca, time.Now().Add(-time.Minute))
+
+	if err := p.ValidateServerCert(leaf.cert.Raw, false); err == nil || !strings.Contains(err.Error(), "outdated") {
+		t.Fatalf("expected an outdated crl error, got %v", err)
+	}
+
+	writeCRL(t, p.TrustedCRL(), ca, time.Now().Add(time.Hour))
+
+	if err := p.ValidateServerCert(leaf.cert.Raw, false); err != nil {
+		t.Fatalf("rejected a server certificate with a current crl: %s", err.Error())
+	}
+}
+
+func TestVerifyImport(t *testing.T) {
+	root := issue(t, "Root CA", true, nil)
+	inter := issue(t, "Intermediate CA", true, root)
+	leaf := issue(t, "gualogger", false, inter)
+	other := issue(t, "Other CA", true, nil)
+
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		issuers []*x509.Certificate
+		now     time.Time
+		ok      bool
+	}{
+		{"full chain", []*x509.Certificate{inter.cert, root.cert}, now, true},
+		{"intermediate only", []*x509.Certificate{inter.cert}, now, true},
+		{"no issuers", nil, now, false},
+		{"foreign issuer", []*x509.Certificate{other.cert}, now, false},
+		{"expired", []*x509.Certificate{inter.cert, root.cert}, now.Add(2 * time.Hour), false},
+		{"not yet valid", []*x509.Certificate{inter.cert, root.cert}, now.Add(-2 * time.Hour), false},
+	}
+
+	for _, tc := range tests {
+		if err := verifyImport(leaf.cert, tc.issuers, tc.now); (err == nil) != tc.ok {
+			t.Errorf("%s: got error %v", tc.name, err)
+		}
+	}
+
+	if err := verifyImport(other.cert, nil, now); err != nil {
+		t.Errorf("self-signed certificate refused: %s", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gualogger/logging"
+	"reflect"
+	"time"
+)
+
+// Cyclically reads all nodes of a poll group and publishes the results until ctx is cancelled
+// Reads are skipped while the opc ua connection is inactive
+func RunPollGroup(ctx context.Context, g *NodeGroup) {
+
+	if g.PollInterval <= 0 {
+		logging.Logger.Error(fmt.Sprintf("poll group %s has no valid poll_interval - group is not polled", g.Name), "func", "RunPollGroup")
+		return
+	}
+
+	ids := g.NodeIDs()
+	last := make(map[string]interface{})
+
+	logging.Logger.Info(fmt.Sprintf("polling group %s with %d nodes every %d seconds", g.Name, len(ids), g.PollInterval), "func", "RunPollGroup")
+
+	tick := time.NewTicker(time.Duration(g.PollInterval) * time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			if !con_active.Load() {
+				continue
+			}
+
+			for _, p := range ReadNodes(ctx, ids) {
+				if g.OnlyChanges {
+					if v, ok := last[p.Id]; ok && reflect.DeepEqual(v, p.Value) {
+						continue
+					}
+					last[p.Id] = p.Value
+				}
+
+				PublishValue(ctx, p)
+			}
+		}
+	}
+}
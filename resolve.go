@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gualogger/logging"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Maps the node ids of the configuration to the node ids of the connected server
+// Configured ids may use namespace uris (nsu=) which are resolved against the NamespaceArray on every connect,
+// or browse paths which are translated by the server on every connect.
+// Payloads keep the configured id so exporters are not affected by changing namespace indexes or node ids
+type NodeResolver struct {
+	sync.RWMutex
+	nodes map[string]*ua.NodeID
+	keys  map[string]string
+}
+
+var resolver = NewNodeResolver()
+
+func NewNodeResolver() *NodeResolver {
+	return &NodeResolver{nodes: make(map[string]*ua.NodeID), keys: make(map[string]string)}
+}
+
+// Browse path of a node relative to its start node, the Root folder if no start node is set
+type BrowsePath struct {
+	StartNode string `json:"start_node"`
+	Path      string `json:"path"`
+}
+
+// Returns the id the browse path is configured, exported and changed at runtime by
+// The path itself if it starts at the Root folder, otherwise the start node followed by the path, e.g. ns=2;s=Line1/2:Temperature
+func (b BrowsePath) ID() string {
+	if b.StartNode == "" {
+		return b.Path
+	}
+	return b.StartNode + "/" + strings.TrimPrefix(b.Path, "/")
+}
+
+// Resolves all ids for the session of c, the previous resolution is discarded
+// Ids listed in paths are browse paths which are translated by the server, all others are node ids.
+// The NamespaceArray is only read if an id uses a namespace uri, failed ids are returned with their error
+func (r *NodeResolver) Resolve(ctx context.Context, c *opcua.Client, ids []string, paths map[string]BrowsePath) map[string]error {
+
+	nodes, keys, errs := resolve(ctx, c, ids, paths)
+
+	r.Lock()
+	r.nodes = nodes
+	r.keys = keys
+	r.Unlock()
+
+	return errs
+}
+
+// Resolves ids for the session of c in addition to the already resolved ones
+func (r *NodeResolver) Add(ctx context.Context, c *opcua.Client, ids []string, paths map[string]BrowsePath) map[string]error {
+
+	nodes, keys, errs := resolve(ctx, c, ids, paths)
+
+	r.Lock()
+	defer r.Unlock()
+
+	for k, nid := range nodes {
+		r.nodes[k] = nid
+	}
+	for n, k := range keys {
+		r.keys[n] = k
+	}
+
+	return errs
+}
+
+func resolve(ctx context.Context, c *opcua.Client, ids []string, paths map[string]BrowsePath) (map[string]*ua.NodeID, map[string]string, map[string]error) {
+
+	errs := make(map[string]error)
+	nodes := make(map[string]*ua.NodeID, len(ids))
+	keys := make(map[string]string, len(ids))
+	bps := make([]string, 0)
+
+	var ns []string
+
+	// the namespace array is only read once and only if a namespace uri has to be resolved
+	namespaces := func() []string {
+		if ns == nil {
+			var err error
+			if ns, err = c.NamespaceArray(ctx); err != nil {
+				ns = []string{}
+				logging.Logger.Error(fmt.Sprintf("unable to read namespace array: %s", err.Error()), "func", "Resolve")
+			}
+		}
+		return ns
+	}
+
+	for _, n := range ids {
+		if _, ok := paths[n]; ok {
+			bps = append(bps, n)
+			continue
+		}
+
+		nid, err := parseNodeID(n, namespaces)
+
+		if err != nil {
+			errs[n] = err
+			continue
+		}
+
+		k := nodeKey(n)
+		nodes[k] = nid
+		keys[nid.String()] = k
+	}
+
+	if len(bps) > 0 {
+		for p, res := range translatePaths(ctx, c, bps, paths, namespaces) {
+			if res.err != nil {
+				errs[p] = res.err
+				continue
+			}
+			k := nodeKey(p)
+			nodes[k] = res.nid
+			keys[res.nid.String()] = k
+		}
+	}
+
+	return nodes, keys, errs
+}
+
+// Returns the node id of the current session for a configured id
+func (r *NodeResolver) NodeID(id string) (*ua.NodeID, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	nid, ok := r.nodes[nodeKey(id)]
+	return nid, ok
+}
+
+// Returns the key of the configured id a node id of the current session was resolved from
+// Node ids that are not part of the configuration are returned as is
+func (r *NodeResolver) Key(nid *ua.NodeID) string {
+	r.RLock()
+	defer r.RUnlock()
+
+	if k, ok := r.keys[nid.String()]; ok {
+		return k
+	}
+	return nid.String()
+}
+
+// Parses a node id, namespace uris are replaced by their index in the namespace array
+func parseNodeID(id string, namespaces func() []string) (*ua.NodeID, error) {
+
+	if !strings.HasPrefix(id, "nsu=") {
+		return ua.ParseNodeID(id)
+	}
+
+	uri, rest, ok := strings.Cut(strings.TrimPrefix(id, "nsu="), ";")
+
+	if !ok {
+		return nil, fmt.Errorf("invalid node id: %s", id)
+	}
+
+	for i, u := range namespaces() {
+		if u == uri {
+			return ua.ParseNodeID(fmt.Sprintf("ns=%d;%s", i, rest))
+		}
+	}
+
+	return nil, fmt.Errorf("namespace uri %s not found in the server namespace array", uri)
+}
+
+type pathResult struct {
+	nid *ua.NodeID
+	err error
+}
+
+// Translates the browse paths of ids to node ids with a single TranslateBrowsePathsToNodeIds request
+func translatePaths(ctx context.Context, c *opcua.Client, ids []string, paths map[string]BrowsePath, namespaces func() []string) map[string]pathResult {
+
+	res := make(map[string]pathResult, len(ids))
+	req := &ua.TranslateBrowsePathsToNodeIDsRequest{}
+	valid := make([]string, 0, len(ids))
+
+	for _, p := range ids {
+		bp := paths[p]
+		start := ua.NewNumericNodeID(0, id.RootFolder)
+
+		if s := bp.StartNode; s != "" {
+			nid, err := parseNodeID(s, namespaces)
+			if err != nil {
+				res[p] = pathResult{err: fmt.Errorf("invalid start node %s: %s", s, err.Error())}
+				continue
+			}
+			start = nid
+		}
+
+		rp, err := relativePath(bp.Path)
+
+		if err != nil {
+			res[p] = pathResult{err: err}
+			continue
+		}
+
+		req.BrowsePaths = append(req.BrowsePaths, &ua.BrowsePath{StartingNode: start, RelativePath: rp})
+		valid = append(valid, p)
+	}
+
+	if len(valid) == 0 {
+		return res
+	}
+
+	err := c.Send(ctx, req, func(v interface{}) error {
+		resp, ok := v.(*ua.TranslateBrowsePathsToNodeIDsResponse)
+
+		if !ok {
+			return ua.StatusBadUnexpectedError
+		}
+
+		for i, p := range valid {
+			switch {
+			case i >= len(resp.Results):
+				res[p] = pathResult{err: fmt.Errorf("no result for browse path")}
+			case resp.Results[i].StatusCode != ua.StatusOK:
+				res[p] = pathResult{err: resp.Results[i].StatusCode}
+			case len(resp.Results[i].Targets) == 0:
+				res[p] = pathResult{err: fmt.Errorf("browse path has no target")}
+			default:
+				res[p] = pathResult{nid: resp.Results[i].Targets[0].TargetID.NodeID}
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		for _, p := range valid {
+			res[p] = pathResult{err: err}
+		}
+	}
+
+	return res
+}
+
+// Parses a browse path like Objects/2:Line1/Press3/Temperature into a relative path of hierarchical references
+// A segment may be prefixed with a numeric namespace index, segments without prefix use the namespace of the previous segment
+func relativePath(p string) (*ua.RelativePath, error) {
+
+	rp := &ua.RelativePath{}
+	ns := uint16(0)
+
+	for _, seg := range strings.Split(strings.Trim(p, "/"), "/") {
+		name := seg
+
+		if i, n, ok := strings.Cut(seg, ":"); ok {
+			if idx, err := strconv.ParseUint(i, 10, 16); err == nil {
+				ns, name = uint16(idx), n
+			}
+		}
+
+		if name == "" {
+			return nil, fmt.Errorf("empty segment in browse path %s", p)
+		}
+
+		rp.Elements = append(rp.Elements, &ua.RelativePathElement{
+			ReferenceTypeID: ua.NewNumericNodeID(0, id.HierarchicalReferences),
+			IncludeSubtypes: true,
+			TargetName:      &ua.QualifiedName{NamespaceIndex: ns, Name: name},
+		})
+	}
+
+	return rp, nil
+}
+
+// Ids of the configured and added browse paths, their kind is known from the configuration instead of the id syntax
+var (
+	path_ids = make(map[string]bool)
+	path_mu  sync.RWMutex
+)
+
+// Registers the ids of browse paths so they are kept as configured by nodeKey
+func registerPaths(paths map[string]BrowsePath) {
+	path_mu.Lock()
+	defer path_mu.Unlock()
+
+	for id := range paths {
+		path_ids[id] = true
+	}
+}
+
+func isBrowsePath(id string) bool {
+	path_mu.RLock()
+	defer path_mu.RUnlock()
+
+	return path_ids[id]
+}
+
+// Returns the key a configured node id is identified by in payloads, filters and aggregates
+// Index based ids are normalized, e.g. ns=0;i=2258 becomes i=2258, namespace uri based ids and browse paths are kept as configured
+func nodeKey(id string) string {
+	if isBrowsePath(id) {
+		return id
+	}
+
+	if nid, err := ua.ParseNodeID(id); err == nil {
+		return nid.String()
+	}
+	return id
+}
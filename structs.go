@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gualogger/handlers"
+	"gualogger/logging"
+	"sort"
+	"sync"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Maximum nesting of structure definitions followed while loading a data type
+const maxStructDepth = 16
+
+// Structured data types of the server, loaded on every connect from the DataTypeDefinition attribute
+// Values of these types are decoded into nested maps keyed by field name.
+// Servers only providing the legacy type dictionaries are not supported, their values are exported as null
+// and a warning is logged once per type.
+type StructRegistry struct {
+	sync.RWMutex
+	types     map[string]*structType
+	encodings map[string]*structType
+
+	wmu    sync.Mutex
+	warned map[string]bool
+}
+
+// Definition of a data type, either a structure, an enumeration or a subtype of a built-in type
+type structType struct {
+	name string
+	def  *ua.StructureDefinition
+	base *ua.NodeID
+}
+
+// Body of an extension object whose type is only known to the server, decoded by the registry on export
+type rawStructure struct {
+	body []byte
+}
+
+func (r *rawStructure) Decode(b []byte) (int, error) {
+	r.body = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+var structs = NewStructRegistry()
+
+func NewStructRegistry() *StructRegistry {
+	return &StructRegistry{types: make(map[string]*structType), encodings: make(map[string]*structType), warned: make(map[string]bool)}
+}
+
+// Logs a warning only the first time for key, unsupported types would otherwise be reported on every connect or value
+func (r *StructRegistry) warnOnce(key string, msg string) {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	if r.warned[key] {
+		return
+	}
+
+	r.warned[key] = true
+
+	logging.Logger.Warn(msg, "func", "LoadStructs")
+}
+
+// Reads the data types of all resolved ids and loads the definitions of all structured types including nested ones
+// Definitions of previous sessions are discarded
+func (r *StructRegistry) Load(ctx context.Context, c *opcua.Client, ids []string) {
+	r.Lock()
+	r.types = make(map[string]*structType)
+	r.encodings = make(map[string]*structType)
+	r.Unlock()
+
+	r.Add(ctx, c, ids)
+}
+
+// Loads the definitions of the data types of ids in addition to the already known ones
+func (r *StructRegistry) Add(ctx context.Context, c *opcua.Client, ids []string) {
+
+	nodes := make([]*ua.ReadValueID, 0, len(ids))
+
+	for _, n := range ids {
+		if nid, ok := resolver.NodeID(n); ok {
+			nodes = append(nodes, &ua.ReadValueID{NodeID: nid, AttributeID: ua.AttributeIDDataType})
+		}
+	}
+
+	if len(nodes) == 0 {
+		return
+	}
+
+	res, err := c.Read(ctx, &ua.ReadRequest{NodesToRead: nodes})
+
+	if err != nil {
+		logging.Logger.Error(fmt.Sprintf("unable to read data types: %s", err.Error()), "func", "LoadStructs")
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	n := len(r.types)
+
+	for _, v := range res.Results {
+		if v.Status != ua.StatusOK || v.Value == nil {
+			continue
+		}
+
+		if dt, ok := v.Value.Value().(*ua.NodeID); ok {
+			r.load(ctx, c, dt, 0)
+		}
+	}
+
+	if len(r.types) > n {
+		logging.Logger.Info(fmt.Sprintf("loaded %d data type definitions", len(r.types)-n), "func", "LoadStructs")
+	}
+}
+
+func (r *StructRegistry) load(ctx context.Context, c *opcua.Client, dt *ua.NodeID, depth int) *structType {
+
+	if builtin(dt) {
+		return nil
+	}
+
+	if t, ok := r.types[dt.String()]; ok {
+		return t
+	}
+
+	if depth > maxStructDepth {
+		logging.Logger.Warn(fmt.Sprintf("data type %s is nested too deep", dt), "func", "LoadStructs")
+		return nil
+	}
+
+	attrs, err := c.Node(dt).Attributes(ctx, ua.AttributeIDBrowseName, ua.AttributeIDDataTypeDefinition)
+
+	if err != nil {
+		logging.Logger.Warn(fmt.Sprintf("unable to read definition of data type %s: %s", dt, err.Error()), "func", "LoadStructs")
+		return nil
+	}
+
+	t := &structType{name: dt.String()}
+
+	if qn, ok := attrValue(attrs, 0).(*ua.QualifiedName); ok {
+		t.name = qn.Name
+	}
+
+	r.types[dt.String()] = t
+
+	var def interface{}
+
+	if eo, ok := attrValue(attrs, 1).(*ua.ExtensionObject); ok {
+		def = eo.Value
+	}
+
+	switch d := def.(type) {
+	case *ua.StructureDefinition:
+		t.def = d
+
+		for _, f := range d.Fields {
+			r.load(ctx, c, f.DataType, depth+1)
+		}
+
+		if d.DefaultEncodingID == nil {
+			break
+		}
+
+		r.encodings[d.DefaultEncodingID.String()] = t
+
+		// types of namespace 0 are decoded by the opc ua stack itself
+		if d.DefaultEncodingID.Namespace() != 0 {
+			registerRaw(d.DefaultEncodingID)
+		}
+
+	case *ua.EnumDefinition:
+		t.base = ua.NewNumericNodeID(0, id.Int32)
+
+	default:
+		parent, err := supertype(ctx, c, dt)
+
+		if err != nil {
+			logging.Logger.Warn(fmt.Sprintf("unable to find super type of data type %s: %s", t.name, err.Error()), "func", "LoadStructs")
+			break
+		}
+
+		if parent.Namespace() == 0 && parent.IntID() == id.Structure {
+			r.warnOnce(dt.String(), fmt.Sprintf("data type %s has no DataTypeDefinition - legacy type dictionaries are not supported, its values are exported as null", t.name))
+			break
+		}
+
+		if p := r.load(ctx, c, parent, depth+1); p != nil {
+			t.def, t.base = p.def, p.base
+		} else {
+			t.base = parent
+		}
+	}
+
+	return t
+}
+
+// Registers the raw structure type for an encoding id, ids already registered by the stack are skipped
+func registerRaw(enc *ua.NodeID) {
+	defer func() {
+		if err := recover(); err != nil {
+			logging.Logger.Warn(fmt.Sprintf("unable to register encoding %s: %v", enc, err), "func", "LoadStructs")
+		}
+	}()
+
+	ua.RegisterExtensionObject(enc, new(rawStructure))
+}
+
+// Returns the parent of a data type following the inverse HasSubtype reference
+func supertype(ctx context.Context, c *opcua.Client, dt *ua.NodeID) (*ua.NodeID, error) {
+
+	refs, err := c.Node(dt).References(ctx, id.HasSubtype, ua.BrowseDirectionInverse, ua.NodeClassDataType, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(refs) == 0 || refs[0].NodeID == nil {
+		return nil, fmt.Errorf("no super type")
+	}
+
+	return refs[0].NodeID.NodeID, nil
+}
+
+// Returns true for the built-in types of namespace 0 which are directly encoded
+func builtin(dt *ua.NodeID) bool {
+	return dt.Namespace() == 0 && dt.IntID() >= uint32(ua.TypeIDBoolean) && dt.IntID() <= uint32(ua.TypeIDDiagnosticInfo)
+}
+
+// Decodes an extension object of a server specific type into a map, other extension objects are returned as is
+func (r *StructRegistry) Decode(eo *ua.ExtensionObject) interface{} {
+
+	if _, ok := eo.Value.(*rawStructure); !ok {
+		return r.decode(eo)
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.decode(eo)
+}
+
+// Decodes an extension object with the read lock held by the caller, nested extension objects are decoded without locking again
+func (r *StructRegistry) decode(eo *ua.ExtensionObject) interface{} {
+
+	raw, ok := eo.Value.(*rawStructure)
+
+	if !ok {
+		if eo.Value == nil && eo.TypeID != nil && eo.EncodingMask != ua.ExtensionObjectEmpty {
+			r.warnOnce(eo.TypeID.NodeID.String(), fmt.Sprintf("values of unknown encoding %s are exported as null", eo.TypeID.NodeID))
+		}
+		return eo.Value
+	}
+
+	t, ok := r.encodings[eo.TypeID.NodeID.String()]
+
+	if !ok {
+		return nil
+	}
+
+	buf := ua.NewBuffer(raw.body)
+
+	v, err := r.decodeStruct(buf, t, 0)
+
+	if err == nil {
+		err = buf.Error()
+	}
+
+	if err != nil {
+		logging.Logger.Warn(fmt.Sprintf("unable to decode value of type %s: %s", t.name, err.Error()), "func", "DecodeStruct")
+		return nil
+	}
+
+	return v
+}
+
+func (r *StructRegistry) decodeStruct(buf *ua.Buffer, t *structType, depth int) (map[string]interface{}, error) {
+
+	if t.def == nil {
+		return nil, fmt.Errorf("%s is not a structure", t.name)
+	}
+
+	if depth > maxStructDepth {
+		return nil, fmt.Errorf("%s is nested too deep", t.name)
+	}
+
+	m := make(map[string]interface{}, len(t.def.Fields))
+
+	switch t.def.StructureType {
+
+	case ua.StructureTypeUnion, ua.StructureTypeUnionWithSubtypedValues:
+		sw := buf.ReadUint32()
+
+		if sw == 0 || int(sw) > len(t.def.Fields) {
+			return m, nil
+		}
+
+		f := t.def.Fields[sw-1]
+		v, err := r.decodeField(buf, f, depth)
+		if err != nil {
+			return nil, err
+		}
+		m[f.Name] = v
+
+	default:
+		var mask uint32
+		bit := 0
+
+		if t.def.StructureType == ua.StructureTypeStructureWithOptionalFields {
+			mask = buf.ReadUint32()
+		}
+
+		for _, f := range t.def.Fields {
+			if t.def.StructureType == ua.StructureTypeStructureWithOptionalFields && f.IsOptional {
+				present := mask&(1<<bit) != 0
+				bit++
+				if !present {
+					continue
+				}
+			}
+
+			v, err := r.decodeField(buf, f, depth)
+			if err != nil {
+				return nil, err
+			}
+			m[f.Name] = v
+		}
+	}
+
+	return m, nil
+}
+
+// Decodes a scalar or array field
+// Multi dimensional arrays are encoded as an Int32 array of dimensions followed by all values and returned as nested arrays
+func (r *StructRegistry) decodeField(buf *ua.Buffer, f *ua.StructureField, depth int) (interface{}, error) {
+
+	if f.ValueRank < 1 {
+		return r.decodeValue(buf, f.DataType, depth)
+	}
+
+	if f.ValueRank == 1 {
+		n := buf.ReadInt32()
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		return r.decodeArray(buf, f.DataType, int(n), depth)
+	}
+
+	n := buf.ReadInt32()
+
+	if n < 0 {
+		return nil, nil
+	}
+
+	if int(n) != int(f.ValueRank) {
+		return nil, fmt.Errorf("field %s has %d dimensions instead of %d", f.Name, n, f.ValueRank)
+	}
+
+	dims := make([]int, n)
+	total := 1
+
+	for i := range dims {
+		dims[i] = int(buf.ReadInt32())
+
+		if dims[i] < 0 {
+			return nil, fmt.Errorf("field %s has a negative dimension", f.Name)
+		}
+
+		total *= dims[i]
+
+		if total > ua.MaxVariantArrayLength {
+			return nil, ua.StatusBadEncodingLimitsExceeded
+		}
+	}
+
+	arr, err := r.decodeArray(buf, f.DataType, total, depth)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return reshape(arr, dims), nil
+}
+
+func (r *StructRegistry) decodeArray(buf *ua.Buffer, dt *ua.NodeID, n int, depth int) ([]interface{}, error) {
+
+	if n > ua.MaxVariantArrayLength {
+		return nil, ua.StatusBadEncodingLimitsExceeded
+	}
+
+	arr := make([]interface{}, n)
+
+	for i := range arr {
+		v, err := r.decodeValue(buf, dt, depth)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = v
+	}
+
+	return arr, nil
+}
+
+// Splits the flat values of a multi dimensional array into nested arrays, the last dimension varies fastest
+func reshape(flat []interface{}, dims []int) []interface{} {
+	if len(dims) == 1 {
+		return flat
+	}
+
+	arr := make([]interface{}, dims[0])
+	size := len(flat) / max(dims[0], 1)
+
+	for i := range arr {
+		arr[i] = reshape(flat[i*size:(i+1)*size], dims[1:])
+	}
+
+	return arr
+}
+
+func (r *StructRegistry) decodeValue(buf *ua.Buffer, dt *ua.NodeID, depth int) (interface{}, error) {
+
+	if builtin(dt) {
+		return r.decodeBuiltin(buf, ua.TypeID(dt.IntID())), buf.Error()
+	}
+
+	t, ok := r.types[dt.String()]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown data type %s", dt)
+	}
+
+	if t.def != nil {
+		return r.decodeStruct(buf, t, depth+1)
+	}
+
+	if t.base != nil {
+		return r.decodeValue(buf, t.base, depth+1)
+	}
+
+	return nil, fmt.Errorf("data type %s can not be decoded", t.name)
+}
+
+// Decodes a value of a built-in type, nested extension objects are decoded by the registry without taking its lock again
+func (r *StructRegistry) decodeBuiltin(buf *ua.Buffer, t ua.TypeID) interface{} {
+
+	var v interface{}
+
+	switch t {
+	case ua.TypeIDBoolean:
+		return buf.ReadBool()
+	case ua.TypeIDSByte:
+		return buf.ReadInt8()
+	case ua.TypeIDByte:
+		return buf.ReadByte()
+	case ua.TypeIDInt16:
+		return buf.ReadInt16()
+	case ua.TypeIDUint16:
+		return buf.ReadUint16()
+	case ua.TypeIDInt32:
+		return buf.ReadInt32()
+	case ua.TypeIDUint32:
+		return buf.ReadUint32()
+	case ua.TypeIDInt64:
+		return buf.ReadInt64()
+	case ua.TypeIDUint64:
+		return buf.ReadUint64()
+	case ua.TypeIDFloat:
+		return buf.ReadFloat32()
+	case ua.TypeIDDouble:
+		return buf.ReadFloat64()
+	case ua.TypeIDString:
+		return buf.ReadString()
+	case ua.TypeIDDateTime:
+		return buf.ReadTime()
+	case ua.TypeIDByteString:
+		return buf.ReadBytes()
+	case ua.TypeIDXMLElement:
+		return ua.XMLElement(buf.ReadString())
+	case ua.TypeIDStatusCode:
+		return ExportValue(ua.StatusCode(buf.ReadUint32()))
+	case ua.TypeIDGUID:
+		v = new(ua.GUID)
+	case ua.TypeIDNodeID:
+		v = new(ua.NodeID)
+	case ua.TypeIDExpandedNodeID:
+		v = new(ua.ExpandedNodeID)
+	case ua.TypeIDQualifiedName:
+		v = new(ua.QualifiedName)
+	case ua.TypeIDLocalizedText:
+		v = new(ua.LocalizedText)
+	case ua.TypeIDExtensionObject:
+		v = new(ua.ExtensionObject)
+	case ua.TypeIDDataValue:
+		v = new(ua.DataValue)
+	case ua.TypeIDVariant:
+		v = new(ua.Variant)
+	case ua.TypeIDDiagnosticInfo:
+		v = new(ua.DiagnosticInfo)
+	default:
+		return nil
+	}
+
+	buf.ReadStruct(v)
+
+	return exportValue(v, r.decode)
+}
+
+// Splits a payload with a structured value into one payload per leaf field
+// Ids and names of the fields are extended with the field path, e.g. ns=2;s=Motor.Speed.Actual
+func flattenPayload(p handlers.Payload) []handlers.Payload {
+
+	m, ok := p.Value.(map[string]interface{})
+
+	if !ok {
+		return []handlers.Payload{p}
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pay := make([]handlers.Payload, 0, len(m))
+
+	for _, k := range keys {
+		c := p
+		c.Value = m[k]
+		c.Id = p.Id + "." + k
+		c.Name = p.Name + "." + k
+		c.Datatype = leafDatatype(m[k])
+		c.Dimensions = nil
+		c.Meta = nil
+
+		if arr, ok := m[k].([]interface{}); ok {
+			c.Dimensions = []int32{int32(len(arr))}
+		}
+
+		pay = append(pay, flattenPayload(c)...)
+	}
+
+	return pay
+}
+
+// Returns the datatype name of a decoded field value
+func leafDatatype(v interface{}) string {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return datatypeNames[ua.TypeIDExtensionObject]
+	case []interface{}:
+		if len(x) == 0 {
+			return datatypeNames[ua.TypeIDVariant] + "[]"
+		}
+		return leafDatatype(x[0]) + "[]"
+	}
+
+	va, err := ua.NewVariant(v)
+
+	if err != nil {
+		return datatypeNames[ua.TypeIDString]
+	}
+
+	return DeferDatatype(va)
+}
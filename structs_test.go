@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// Registry with an Outer structure of an Int32 matrix and a nested extension object holding an Inner structure
+func testRegistry() (*StructRegistry, *ua.NodeID, *ua.NodeID) {
+	r := NewStructRegistry()
+
+	innerEnc := ua.NewNumericNodeID(2, 5001)
+	outerEnc := ua.NewNumericNodeID(2, 5002)
+
+	inner := &structType{name: "Inner", def: &ua.StructureDefinition{
+		DefaultEncodingID: innerEnc,
+		Fields:            []*ua.StructureField{{Name: "Value", DataType: ua.NewNumericNodeID(0, id.Int32), ValueRank: -1}},
+	}}
+
+	outer := &structType{name: "Outer", def: &ua.StructureDefinition{
+		DefaultEncodingID: outerEnc,
+		Fields: []*ua.StructureField{
+			{Name: "Matrix", DataType: ua.NewNumericNodeID(0, id.Int32), ValueRank: 2},
+			{Name: "Nested", DataType: ua.NewNumericNodeID(0, id.Structure), ValueRank: -1},
+		},
+	}}
+
+	r.types["ns=2;i=3001"], r.encodings[innerEnc.String()] = inner, inner
+	r.types["ns=2;i=3002"], r.encodings[outerEnc.String()] = outer, outer
+
+	registerRaw(innerEnc)
+	registerRaw(outerEnc)
+
+	// values are exported through the package registry
+	structs = r
+
+	return r, innerEnc, outerEnc
+}
+
+func encodeExtensionObject(enc *ua.NodeID, body []byte) []byte {
+	buf := ua.NewBuffer(nil)
+	buf.WriteStruct(ua.NewExpandedNodeID(enc, "", 0))
+	buf.WriteByte(ua.ExtensionObjectBinary)
+	buf.WriteUint32(uint32(len(body)))
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func outerValue(t *testing.T, innerEnc, outerEnc *ua.NodeID) *ua.ExtensionObject {
+	t.Helper()
+
+	ib := ua.NewBuffer(nil)
+	ib.WriteInt32(7)
+
+	ob := ua.NewBuffer(nil)
+	// dimensions 2x3 followed by the values
+	ob.WriteInt32(2)
+	ob.WriteInt32(2)
+	ob.WriteInt32(3)
+	for i := int32(1); i <= 6; i++ {
+		ob.WriteInt32(i)
+	}
+	ob.Write(encodeExtensionObject(innerEnc, ib.Bytes()))
+
+	eo := new(ua.ExtensionObject)
+
+	if _, err := eo.Decode(encodeExtensionObject(outerEnc, ob.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	return eo
+}
+
+func TestDecodeStruct(t *testing.T) {
+	r, innerEnc, outerEnc := testRegistry()
+
+	got := r.Decode(outerValue(t, innerEnc, outerEnc))
+
+	want := map[string]interface{}{
+		"Matrix": []interface{}{[]interface{}{int32(1), int32(2), int32(3)}, []interface{}{int32(4), int32(5), int32(6)}},
+		"Nested": map[string]interface{}{"Value": int32(7)},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %v, want %v", got, want)
+	}
+}
+
+// Nested extension objects must not take the read lock again, a waiting Load would otherwise deadlock the decode
+func TestDecodeNestedWithPendingLoad(t *testing.T) {
+	r, innerEnc, outerEnc := testRegistry()
+	eo := outerValue(t, innerEnc, outerEnc)
+
+	done := make(chan struct{})
+
+	go func() {
+		r.RLock()
+		defer r.RUnlock()
+
+		locked := make(chan struct{})
+		go func() {
+			close(locked)
+			r.Lock()
+			r.Unlock()
+		}()
+		<-locked
+		time.Sleep(10 * time.Millisecond)
+
+		r.decode(eo)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("decoding a nested extension object blocked on a pending writer")
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"gualogger/logging"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/monitor"
+	"github.com/gopcua/opcua/stats"
+	"github.com/gopcua/opcua/ua"
+)
+
+// State of the connection handled by the supervisor
+type ConnState int
+
+const (
+	StateConnecting ConnState = iota
+	StateConnected
+	StateDegraded
+	StateReconnecting
+	StateFailed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDegraded:
+		return "degraded"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// Health of an established session as reported by Check
+type Health int
+
+const (
+	HealthOK Health = iota
+	HealthDegraded
+	HealthSubscriptionLost
+	HealthSessionLost
+)
+
+// Session handled by the supervisor - Connect establishes the connection including all subscriptions,
+// Check reports the health of the established session, Restore recreates the subscriptions on the
+// existing session and Close tears everything down
+type Session interface {
+	Connect(ctx context.Context) error
+	Check(ctx context.Context) (Health, string)
+	Restore(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+const (
+	minBackoff        = time.Second
+	maxBackoff        = time.Minute
+	superviseInterval = time.Second
+	minDegradedWindow = 3 * time.Second
+	closeTimeout      = 10 * time.Second
+)
+
+// Per connection state machine
+//
+//	connecting   -> connected     session established
+//	connecting   -> failed        retry_count consecutive attempts failed
+//	connected    -> connected     subscriptions lost and restored on the same session
+//	connected    -> reconnecting  session lost or subscriptions could not be restored
+//	connected    -> degraded      session reports publish timeouts or dropped notifications
+//	degraded     -> connected     session healthy again
+//	degraded     -> reconnecting  session degraded for the full degraded timeout
+//	reconnecting -> connected     session re-established
+//	reconnecting -> failed        retry_count consecutive attempts failed
+type Supervisor struct {
+	session         Session
+	state           ConnState
+	retries         int
+	attempts        int
+	degradedTimeout time.Duration
+	degradedSince   time.Time
+	onChange        func(from ConnState, to ConnState)
+	sleep           func(ctx context.Context, d time.Duration) bool
+}
+
+// Initializes a new supervisor in state connecting
+// retries is the number of consecutive failed connection attempts before the supervisor fails
+func NewSupervisor(s Session, retries int, degradedTimeout time.Duration) *Supervisor {
+	if degradedTimeout < minDegradedWindow {
+		degradedTimeout = minDegradedWindow
+	}
+
+	return &Supervisor{session: s, state: StateConnecting, retries: retries, degradedTimeout: degradedTimeout, sleep: sleep}
+}
+
+// Returns the current state
+func (s *Supervisor) State() ConnState {
+	return s.state
+}
+
+// Runs the state machine until ctx is cancelled or the supervisor fails
+// The session is closed on return, an error is returned if the maximum number of retries was exceeded
+func (s *Supervisor) Run(ctx context.Context) error {
+
+	defer func() {
+		cctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+		s.session.Close(cctx)
+	}()
+
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		switch s.state {
+
+		case StateConnecting, StateReconnecting:
+			if err := s.session.Connect(ctx); err != nil {
+				s.attempts++
+
+				logging.Logger.Error(fmt.Sprintf("connection attempt %d/%d failed: %s", s.attempts, s.retries, err.Error()), "func", "Supervisor")
+
+				if s.attempts > s.retries {
+					s.transition(StateFailed)
+					continue
+				}
+
+				if !s.sleep(ctx, backoff(s.attempts)) {
+					return ctx.Err()
+				}
+				continue
+			}
+
+			s.attempts = 0
+			s.degradedSince = time.Time{}
+			s.transition(StateConnected)
+
+		case StateConnected, StateDegraded:
+			if !s.sleep(ctx, superviseInterval) {
+				return ctx.Err()
+			}
+
+			h, reason := s.session.Check(ctx)
+
+			switch h {
+			case HealthSessionLost:
+				logging.Logger.Warn(fmt.Sprintf("session lost: %s - reconnecting", reason), "func", "Supervisor")
+				s.session.Close(ctx)
+				s.transition(StateReconnecting)
+
+			case HealthSubscriptionLost:
+				logging.Logger.Warn(fmt.Sprintf("subscription lost: %s - recreating subscriptions", reason), "func", "Supervisor")
+
+				if err := s.session.Restore(ctx); err != nil {
+					logging.Logger.Error(fmt.Sprintf("unable to recreate subscriptions: %s - reconnecting", err.Error()), "func", "Supervisor")
+					s.session.Close(ctx)
+					s.transition(StateReconnecting)
+					continue
+				}
+
+				logging.Logger.Info("subscriptions recreated", "func", "Supervisor")
+
+			case HealthDegraded:
+				if s.degradedSince.IsZero() {
+					logging.Logger.Warn(fmt.Sprintf("session degraded: %s", reason), "func", "Supervisor")
+					s.degradedSince = time.Now()
+				}
+
+				if time.Since(s.degradedSince) > s.degradedTimeout {
+					logging.Logger.Warn(fmt.Sprintf("session degraded for %s - reconnecting", s.degradedTimeout), "func", "Supervisor")
+					s.session.Close(ctx)
+					s.transition(StateReconnecting)
+					continue
+				}
+
+				s.transition(StateDegraded)
+
+			default:
+				s.degradedSince = time.Time{}
+				s.transition(StateConnected)
+			}
+
+		case StateFailed:
+			return fmt.Errorf("maximum number of %d retries exceeded", s.retries)
+		}
+	}
+}
+
+func (s *Supervisor) transition(to ConnState) {
+	if s.state == to {
+		return
+	}
+
+	from := s.state
+	s.state = to
+
+	logging.Logger.Info(fmt.Sprintf("connection state changed: %s -> %s", from, to), "func", "Supervisor")
+
+	con_active.Store(to == StateConnected || to == StateDegraded)
+
+	if s.onChange != nil {
+		s.onChange(from, to)
+	}
+}
+
+// Returns the exponential backoff for the given attempt, capped at one minute
+func backoff(attempt int) time.Duration {
+	d := minBackoff
+
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+
+	return d
+}
+
+// Waits for d, returns false if ctx was cancelled in the meantime
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Publish errors after which the stack pauses its publish loop because the session is gone
+var sessionLostCodes = []ua.StatusCode{
+	ua.StatusBadSessionIDInvalid,
+	ua.StatusBadSessionNotActivated,
+	ua.StatusBadSessionClosed,
+	ua.StatusBadServerNotConnected,
+}
+
+// Publish errors reported when the server no longer knows the subscriptions of the session
+var subscriptionLostCodes = []ua.StatusCode{
+	ua.StatusBadNoSubscription,
+	ua.StatusBadSubscriptionIDInvalid,
+}
+
+// Session implementation for an opc ua server based on the configuration
+//
+// The opc ua stack neither exposes connection state events nor publish keepalives, therefore the health is derived from
+// the client connection state, the publish errors recorded in the stack statistics and the asynchronous subscription
+// errors including status change notifications
+type opcSession struct {
+	cfg       *OpcConfig
+	client    *opcua.Client
+	cancel    context.CancelFunc
+	wg        *sync.WaitGroup // subscriptions of the current session, a new group per session as Close may stop waiting on the old one
+	connected bool
+	subLost   atomic.Value // string
+	slow      atomic.Bool
+	errs      map[string]int64
+}
+
+// Creates the client and all subscriptions, missed values are backfilled if the session was connected before
+func (s *opcSession) Connect(ctx context.Context) error {
+
+	c, err := s.cfg.Connection.CreateClient(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	logging.Logger.Info(fmt.Sprintf("successfully connected to opcua on endpoint %s:%d", s.cfg.Connection.Endpoint, s.cfg.Connection.Port), "func", "Connect")
+
+	s.resolve(ctx, c)
+
+	metadata.Load(ctx, c, nodeset.AllNodeIDs())
+	structs.Load(ctx, c, nodeset.AllNodeIDs())
+
+	if s.connected && s.cfg.Subscription.Backfill {
+		Backfill(ctx, c, time.Now())
+	}
+
+	s.client = c
+	s.wg = &sync.WaitGroup{}
+
+	if err := s.subscribe(ctx); err != nil {
+		c.Close(ctx)
+		s.client = nil
+		return err
+	}
+
+	s.connected = true
+
+	return nil
+}
+
+// Resolves the configured node ids and browse paths on the server, failures are reported per node
+func (s *opcSession) resolve(ctx context.Context, c *opcua.Client) {
+
+	ids := append(nodeset.AllNodeIDs(), s.cfg.Events.Notifiers...)
+
+	errs := resolver.Resolve(ctx, c, ids, nodeset.BrowsePaths())
+
+	for id, err := range errs {
+		logging.Logger.Error(fmt.Sprintf("unable to resolve node %s - node is skipped: %s", id, err.Error()), "func", "Connect")
+	}
+
+	if len(errs) > 0 {
+		logging.Logger.Warn(fmt.Sprintf("resolved %d of %d nodes", len(ids)-len(errs), len(ids)), "func", "Connect")
+	}
+}
+
+// Creates the data change and event subscriptions for the current node set on the existing client
+func (s *opcSession) subscribe(ctx context.Context) error {
+
+	subctx, cancel := context.WithCancel(ctx)
+
+	s.subLost.Store("")
+	s.slow.Store(false)
+
+	if err := InitSubs(s.client, ctx, subctx, &s.cfg.Subscription, s.onSubError, s.wg); err != nil {
+		cancel()
+		return fmt.Errorf("error while creating node monitor: %s", err.Error())
+	}
+
+	if len(s.cfg.Events.Notifiers) > 0 {
+		s.wg.Add(1)
+		go CreateEventSubscription(ctx, subctx, s.client, &s.cfg.Events, s.lost, s.wg)
+	}
+
+	s.cancel = cancel
+
+	// errors recorded while the subscriptions were created do not concern the new subscriptions
+	s.errs = publishErrors()
+
+	return nil
+}
+
+// Handles asynchronous errors of the node monitor
+func (s *opcSession) onSubError(_ *opcua.Client, _ *monitor.Subscription, err error) {
+	switch {
+	case errors.Is(err, monitor.ErrSlowConsumer):
+		s.slow.Store(true)
+	case strings.Contains(err.Error(), "StatusChangeNotification"), errors.Is(err, ua.StatusBadSubscriptionIDInvalid), errors.Is(err, ua.StatusBadNoSubscription):
+		s.lost(err)
+	default:
+		logging.Logger.Error(fmt.Sprintf("subscription error: %s", err.Error()), "func", "Supervisor")
+	}
+}
+
+func (s *opcSession) lost(err error) {
+	s.subLost.Store(err.Error())
+}
+
+// Reports the session as lost if the client is no longer connected or the stack paused publishing because of an invalid session,
+// subscriptions as lost on status change notifications or if the server no longer knows them and the session as degraded
+// if publish requests timed out or notifications were dropped since the last check
+func (s *opcSession) Check(ctx context.Context) (Health, string) {
+
+	if s.client == nil {
+		return HealthSessionLost, "no client"
+	}
+
+	if st := s.client.State(); st != opcua.Connected {
+		return HealthSessionLost, fmt.Sprintf("client state %s", st)
+	}
+
+	errs := publishErrors()
+	prev := s.errs
+	s.errs = errs
+
+	for _, c := range sessionLostCodes {
+		if k := statusKey(c); errs[k] > prev[k] {
+			return HealthSessionLost, fmt.Sprintf("publish failed with %s", c)
+		}
+	}
+
+	if r, _ := s.subLost.Swap("").(string); r != "" {
+		return HealthSubscriptionLost, r
+	}
+
+	for _, c := range subscriptionLostCodes {
+		if k := statusKey(c); errs[k] > prev[k] {
+			return HealthSubscriptionLost, fmt.Sprintf("publish failed with %s", c)
+		}
+	}
+
+	if k := statusKey(ua.StatusBadTimeout); errs[k] > prev[k] {
+		return HealthDegraded, "publish requests timed out"
+	}
+
+	if s.slow.Swap(false) {
+		return HealthDegraded, "notifications dropped by slow consumer"
+	}
+
+	return HealthOK, ""
+}
+
+// Cancels the current subscriptions and recreates them with the current node set on the same session
+func (s *opcSession) Restore(ctx context.Context) error {
+	if s.client == nil {
+		return fmt.Errorf("no client")
+	}
+
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+
+	return s.subscribe(ctx)
+}
+
+// Terminates all subscriptions and waits until they are deleted on the server before the session is closed
+func (s *opcSession) Close(ctx context.Context) error {
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+
+	if s.wg != nil {
+		wg := s.wg
+		s.wg = nil
+
+		done := make(chan struct{})
+
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			logging.Logger.Warn("subscriptions were not terminated in time - closing session", "func", "Close")
+		}
+	}
+
+	if s.client == nil {
+		return nil
+	}
+
+	err := s.client.Close(ctx)
+	s.client = nil
+
+	return err
+}
+
+// Returns a snapshot of the publish error counters of the opc ua stack
+func publishErrors() map[string]int64 {
+	errs := make(map[string]int64)
+
+	stats.Error().Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			errs[kv.Key] = v.Value()
+		}
+	})
+
+	return errs
+}
+
+// Returns the key under which the stack statistics count a status code
+func statusKey(c ua.StatusCode) string {
+	return "ua." + ua.StatusCodes[c].Name
+}
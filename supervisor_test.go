@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fake session answering Connect, Check and Restore from scripted results
+// Once a script is exhausted Connect succeeds, Check reports HealthOK and Restore succeeds
+type fakeSession struct {
+	sync.Mutex
+	connects []error
+	checks   []Health
+	restores []error
+	calls    map[string]int
+	onCheck  func(n int)
+}
+
+func newFakeSession() *fakeSession {
+	return &fakeSession{calls: make(map[string]int)}
+}
+
+func (f *fakeSession) Connect(ctx context.Context) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.calls["connect"]++
+
+	if len(f.connects) == 0 {
+		return nil
+	}
+
+	err := f.connects[0]
+	f.connects = f.connects[1:]
+	return err
+}
+
+func (f *fakeSession) Check(ctx context.Context) (Health, string) {
+	f.Lock()
+	f.calls["check"]++
+	n := f.calls["check"]
+
+	h := HealthOK
+	if len(f.checks) > 0 {
+		h = f.checks[0]
+		f.checks = f.checks[1:]
+	}
+	f.Unlock()
+
+	if f.onCheck != nil {
+		f.onCheck(n)
+	}
+
+	return h, "fake"
+}
+
+func (f *fakeSession) Restore(ctx context.Context) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.calls["restore"]++
+
+	if len(f.restores) == 0 {
+		return nil
+	}
+
+	err := f.restores[0]
+	f.restores = f.restores[1:]
+	return err
+}
+
+func (f *fakeSession) Close(ctx context.Context) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.calls["close"]++
+	return nil
+}
+
+func (f *fakeSession) count(call string) int {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.calls[call]
+}
+
+// Supervisor with a recorded clock - backoff sleeps are recorded and return immediately
+type testSupervisor struct {
+	*Supervisor
+	sleeps      []time.Duration
+	transitions []ConnState
+}
+
+func newTestSupervisor(s Session, retries int) *testSupervisor {
+	ts := &testSupervisor{Supervisor: NewSupervisor(s, retries, time.Minute)}
+
+	ts.sleep = func(ctx context.Context, d time.Duration) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		// supervision sleeps happen while connected, backoff sleeps while (re)connecting
+		if st := ts.State(); st == StateConnecting || st == StateReconnecting {
+			ts.sleeps = append(ts.sleeps, d)
+		}
+		return true
+	}
+
+	ts.onChange = func(from ConnState, to ConnState) {
+		ts.transitions = append(ts.transitions, to)
+	}
+
+	return ts
+}
+
+var errConnect = errors.New("connection refused")
+
+func TestBackoff(t *testing.T) {
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, time.Minute, time.Minute}
+
+	for i, w := range want {
+		if got := backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
+
+func TestSupervisorRetriesExceeded(t *testing.T) {
+	fs := newFakeSession()
+	fs.connects = []error{errConnect, errConnect, errConnect, errConnect, errConnect}
+
+	sv := newTestSupervisor(fs, 3)
+
+	err := sv.Run(context.Background())
+
+	if err == nil {
+		t.Fatal("expected an error after exceeding the retries")
+	}
+
+	if got := fs.count("connect"); got != 4 {
+		t.Errorf("connect called %d times, want 4", got)
+	}
+
+	if want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}; !reflect.DeepEqual(sv.sleeps, want) {
+		t.Errorf("backoff sleeps = %v, want %v", sv.sleeps, want)
+	}
+
+	if want := []ConnState{StateFailed}; !reflect.DeepEqual(sv.transitions, want) {
+		t.Errorf("transitions = %v, want %v", sv.transitions, want)
+	}
+
+	if fs.count("close") != 1 {
+		t.Errorf("session closed %d times, want 1", fs.count("close"))
+	}
+}
+
+func TestSupervisorBackoffReset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fs := newFakeSession()
+	// two failed attempts, connect, lose the session, one failed attempt, connect
+	fs.connects = []error{errConnect, errConnect, nil, errConnect}
+	fs.checks = []Health{HealthSessionLost}
+	fs.onCheck = func(n int) {
+		if n == 3 {
+			cancel()
+		}
+	}
+
+	sv := newTestSupervisor(fs, 3)
+
+	if err := sv.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run returned %v, want context.Canceled", err)
+	}
+
+	if want := []time.Duration{time.Second, 2 * time.Second, time.Second}; !reflect.DeepEqual(sv.sleeps, want) {
+		t.Errorf("backoff sleeps = %v, want %v - the backoff must restart after a successful connect", sv.sleeps, want)
+	}
+
+	if want := []ConnState{StateConnected, StateReconnecting, StateConnected}; !reflect.DeepEqual(sv.transitions, want) {
+		t.Errorf("transitions = %v, want %v", sv.transitions, want)
+	}
+}
+
+func TestSupervisorSubscriptionLost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fs := newFakeSession()
+	fs.checks = []Health{HealthSubscriptionLost, HealthOK, HealthSubscriptionLost}
+	fs.restores = []error{nil, errors.New("too many subscriptions")}
+	fs.onCheck = func(n int) {
+		if n == 4 {
+			cancel()
+		}
+	}
+
+	sv := newTestSupervisor(fs, 3)
+	sv.Run(ctx)
+
+	if got := fs.count("restore"); got != 2 {
+		t.Errorf("restore called %d times, want 2", got)
+	}
+
+	// the first loss is restored on the session, the failed restore reconnects
+	if want := []ConnState{StateConnected, StateReconnecting, StateConnected}; !reflect.DeepEqual(sv.transitions, want) {
+		t.Errorf("transitions = %v, want %v", sv.transitions, want)
+	}
+
+	if got := fs.count("connect"); got != 2 {
+		t.Errorf("connect called %d times, want 2", got)
+	}
+}
+
+func TestSupervisorDegraded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fs := newFakeSession()
+	fs.checks = []Health{HealthDegraded, HealthOK}
+	for i := 0; i < 20; i++ {
+		fs.checks = append(fs.checks, HealthDegraded)
+	}
+
+	sv := newTestSupervisor(fs, 3)
+	sv.degradedTimeout = 20 * time.Millisecond
+
+	sleep := sv.sleep
+	sv.sleep = func(ctx context.Context, d time.Duration) bool {
+		time.Sleep(10 * time.Millisecond)
+		return sleep(ctx, d)
+	}
+
+	record := sv.onChange
+	sv.onChange = func(from ConnState, to ConnState) {
+		record(from, to)
+		if to == StateReconnecting {
+			cancel()
+		}
+	}
+
+	sv.Run(ctx)
+
+	// a short degradation recovers, a lasting one reconnects
+	want := []ConnState{StateConnected, StateDegraded, StateConnected, StateDegraded, StateReconnecting}
+
+	if !reflect.DeepEqual(sv.transitions, want) {
+		t.Errorf("transitions = %v, want %v", sv.transitions, want)
+	}
+
+	if got := fs.count("close"); got != 2 {
+		t.Errorf("session closed %d times, want 2", got)
+	}
+}
+
+func TestSupervisorCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	fs := newFakeSession()
+	fs.connects = []error{errConnect}
+
+	sv := newTestSupervisor(fs, 3)
+	sv.sleep = func(ctx context.Context, d time.Duration) bool {
+		cancel()
+		return sleep(ctx, d)
+	}
+
+	done := make(chan error)
+	go func() { done <- sv.Run(ctx) }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run returned %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+
+	if fs.count("close") != 1 {
+		t.Errorf("session closed %d times, want 1", fs.count("close"))
+	}
+
+	if sv.State() != StateConnecting {
+		t.Errorf("state = %s, want connecting", sv.State())
+	}
+}
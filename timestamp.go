@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"gualogger/logging"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+// Sources of Payload.TS, configured with the `timestamp_source` key of the subscription or a node
+const (
+	TimestampSource  = "source"
+	TimestampServer  = "server"
+	TimestampReceive = "receive"
+)
+
+// Minimum time between two clock skew warnings of the same node
+const skewLogInterval = 10 * time.Minute
+
+var timestamps *TimestampSelector
+
+// Selects the timestamp of a sample according to the configured source of its node
+// Zero timestamps fall back to the next source: source -> server -> receive, server -> source -> receive
+type TimestampSelector struct {
+	sync.Mutex
+	def    string
+	nodes  map[string]string
+	skew   time.Duration
+	warned map[string]time.Time
+}
+
+// Initializes a new selector with the subscription default and the per node sources
+func NewTimestampSelector(s *Subscription) *TimestampSelector {
+	t := &TimestampSelector{
+		def:    validSource(s.TimestampSource),
+		nodes:  make(map[string]string),
+		skew:   time.Duration(s.ClockSkew) * time.Second,
+		warned: make(map[string]time.Time),
+	}
+
+	for _, n := range s.NodeConfigs() {
+		if n.TimestampSource != "" {
+			t.nodes[nodeKey(n.ID())] = validSource(n.TimestampSource)
+		}
+	}
+
+	return t
+}
+
+func validSource(s string) string {
+	switch s {
+	case TimestampSource, TimestampServer, TimestampReceive:
+		return s
+	case "":
+		return TimestampSource
+	default:
+		logging.Logger.Warn(fmt.Sprintf("unknown timestamp source %s - using source timestamps", s), "func", "NewTimestampSelector")
+		return TimestampSource
+	}
+}
+
+// Returns the timestamp of a sample of node id, recv is the time gualogger received it
+// recv is zero for historic values, which then only fall back to the server timestamp
+func (t *TimestampSelector) Select(id string, dv *ua.DataValue, recv time.Time) time.Time {
+	src := t.def
+
+	if s, ok := t.nodes[id]; ok {
+		src = s
+	}
+
+	var chain []time.Time
+
+	switch src {
+	case TimestampServer:
+		chain = []time.Time{dv.ServerTimestamp, dv.SourceTimestamp, recv}
+	case TimestampReceive:
+		chain = []time.Time{recv, dv.SourceTimestamp, dv.ServerTimestamp}
+	default:
+		chain = []time.Time{dv.SourceTimestamp, dv.ServerTimestamp, recv}
+	}
+
+	for _, ts := range chain {
+		if !ts.IsZero() {
+			return ts
+		}
+	}
+
+	return time.Time{}
+}
+
+// Logs a warning if the source timestamp of a received sample differs from the local time by more than the configured threshold
+// Only samples of data change notifications are checked, read values may carry the time of their last change
+func (t *TimestampSelector) CheckSkew(id string, dv *ua.DataValue, recv time.Time) {
+	if t.skew <= 0 || dv.SourceTimestamp.IsZero() {
+		return
+	}
+
+	d := recv.Sub(dv.SourceTimestamp)
+
+	if d.Abs() <= t.skew {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if time.Since(t.warned[id]) < skewLogInterval {
+		return
+	}
+
+	t.warned[id] = time.Now()
+
+	logging.Logger.Warn(fmt.Sprintf("source timestamp of node %s differs from local time by %s", id, d.Round(time.Millisecond)), "func", "CheckSkew")
+}